@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiSendPath - HTTP endpoint for send messages to chats from scripts
+const apiSendPath = "/api/send"
+
+// apiMaxRequestSize - max size of request to HTTP API (50 MB is limit of Telegram Bot API for upload)
+const apiMaxRequestSize = 50 * 1024 * 1024
+
+// apiRequest - request for send message from HTTP API, processed in main loop
+type apiRequest struct {
+	To       string `json:"to"`     // chat ID, user ID or @username
+	Text     string `json:"text"`   // text of message or caption of file
+	Format   string `json:"format"` // format of text: markdown, markdownv2, html, pre
+	fileName string
+	fileData []byte
+	result   chan error // result of sending, nil if message is queued
+}
+
+// apiHTTPError - error with HTTP status
+type apiHTTPError struct {
+	status int
+	error
+}
+
+// apiSendHandler - handler for POST /api/send, request may be JSON ({"to": "@user", "text": "..."})
+// or form (to, text, format, file fields), request is authorized by "Authorization: Bearer <token>" header
+func apiSendHandler(apiToken string, apiSignal chan<- apiRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, apiMaxRequestSize)
+		request, err := parseAPIRequest(r, apiToken)
+		if err == nil {
+			request.result = make(chan error, 1)
+			apiSignal <- request
+			err = <-request.result
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]interface{}{"ok": err == nil}
+		if err != nil {
+			status := http.StatusBadRequest
+			if httpErr, ok := err.(apiHTTPError); ok {
+				status = httpErr.status
+			}
+			w.WriteHeader(status)
+			response["error"] = err.Error()
+			log.Printf("API request from %s failed: %s", r.RemoteAddr, err)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("write API response failed: %s", err)
+		}
+	}
+}
+
+// parseAPIRequest - check authorization and get request from JSON or form
+func parseAPIRequest(r *http.Request, apiToken string) (request apiRequest, err error) {
+	if r.Method != http.MethodPost {
+		return request, apiHTTPError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)}
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if apiToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+		return request, apiHTTPError{http.StatusUnauthorized, fmt.Errorf("unauthorized")}
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return request, fmt.Errorf("parse JSON failed: %s", err)
+		}
+	} else {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err = r.ParseMultipartForm(apiMaxRequestSize); err != nil {
+				return request, fmt.Errorf("parse form failed: %s", err)
+			}
+		}
+		request.To, request.Text, request.Format = r.FormValue("to"), r.FormValue("text"), r.FormValue("format")
+
+		if file, header, err := r.FormFile("file"); err == nil {
+			defer func() { _ = file.Close() }()
+			if request.fileData, err = ioutil.ReadAll(file); err != nil {
+				return request, fmt.Errorf("read file failed: %s", err)
+			}
+			request.fileName = header.Filename
+		} else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+			return request, fmt.Errorf("read file failed: %s", err)
+		}
+	}
+
+	switch {
+	case request.To == "":
+		return request, fmt.Errorf("chat or user (to) is required")
+	case request.Text == "" && len(request.fileData) == 0:
+		return request, fmt.Errorf("text or file is required")
+	case request.Format != "" && !isValidFormat(request.Format):
+		return request, fmt.Errorf("unknown format: %s", request.Format)
+	}
+
+	return request, nil
+}
+
+// apiSend - send message from HTTP API to chat, users are resolved to their private chats
+func apiSend(users Users, messageSignal chan<- BotMessage, request apiRequest) error {
+	chatID, err := strconv.Atoi(request.To)
+	if userID := users.FindByIDOrUserName(request.To); userID != 0 {
+		if chatID = users.list[userID].PrivateChatID; chatID == 0 {
+			return apiHTTPError{http.StatusNotFound, fmt.Errorf("user %s has no private chat with bot", request.To)}
+		}
+	} else if err != nil {
+		return apiHTTPError{http.StatusNotFound, fmt.Errorf("user %s not found", request.To)}
+	}
+
+	if len(request.fileData) == 0 {
+		sendMessage(messageSignal, chatID, []byte(request.Text), request.Format)
+		return nil
+	}
+
+	messageType, _ := detectOutputFile(request.fileData)
+	if messageType == msgIsText {
+		messageType = msgIsDocument
+	}
+	go func() {
+		messageSignal <- BotMessage{
+			chatID:      chatID,
+			messageType: messageType,
+			fileName:    request.fileName,
+			fileData:    request.fileData,
+			caption:     request.Text,
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_parseAPIRequest(t *testing.T) {
+	multipartBody := &bytes.Buffer{}
+	multipartWriter := multipart.NewWriter(multipartBody)
+	_ = multipartWriter.WriteField("to", "@user")
+	_ = multipartWriter.WriteField("text", "caption")
+	fileWriter, _ := multipartWriter.CreateFormFile("file", "report.txt")
+	_, _ = fileWriter.Write([]byte("report data"))
+	_ = multipartWriter.Close()
+
+	data := []struct {
+		method, token, contentType, body string
+		apiToken                         string
+		request                          apiRequest
+		errStatus                        int
+		errText                          string
+	}{
+		{
+			method: "POST", token: "secret", contentType: "application/json", apiToken: "secret",
+			body:    `{"to": "@user", "text": "hello", "format": "html"}`,
+			request: apiRequest{To: "@user", Text: "hello", Format: "html"},
+		},
+		{
+			method: "POST", token: "secret", contentType: "application/x-www-form-urlencoded", apiToken: "secret",
+			body:    "to=-100123&text=hello+world",
+			request: apiRequest{To: "-100123", Text: "hello world"},
+		},
+		{
+			method: "POST", token: "secret", contentType: multipartWriter.FormDataContentType(), apiToken: "secret",
+			body:    multipartBody.String(),
+			request: apiRequest{To: "@user", Text: "caption", fileName: "report.txt", fileData: []byte("report data")},
+		},
+		{
+			method: "GET", token: "secret", apiToken: "secret",
+			errStatus: http.StatusMethodNotAllowed, errText: "method GET not allowed",
+		},
+		{
+			method: "POST", token: "wrong", contentType: "application/json", apiToken: "secret",
+			body:      `{"to": "@user", "text": "hello"}`,
+			errStatus: http.StatusUnauthorized, errText: "unauthorized",
+		},
+		{
+			method: "POST", token: "", contentType: "application/json", apiToken: "",
+			body:      `{"to": "@user", "text": "hello"}`,
+			errStatus: http.StatusUnauthorized, errText: "unauthorized",
+		},
+		{
+			method: "POST", token: "secret", contentType: "application/json", apiToken: "secret",
+			body:      `{"to": "@user"`,
+			errStatus: http.StatusBadRequest, errText: "parse JSON failed",
+		},
+		{
+			method: "POST", token: "secret", contentType: "application/json", apiToken: "secret",
+			body:      `{"text": "hello"}`,
+			errStatus: http.StatusBadRequest, errText: "chat or user (to) is required",
+		},
+		{
+			method: "POST", token: "secret", contentType: "application/json", apiToken: "secret",
+			body:      `{"to": "@user"}`,
+			errStatus: http.StatusBadRequest, errText: "text or file is required",
+		},
+		{
+			method: "POST", token: "secret", contentType: "application/json", apiToken: "secret",
+			body:      `{"to": "@user", "text": "hello", "format": "rtf"}`,
+			errStatus: http.StatusBadRequest, errText: "unknown format: rtf",
+		},
+	}
+
+	for i, item := range data {
+		r := httptest.NewRequest(item.method, apiSendPath, strings.NewReader(item.body))
+		r.Header.Set("Authorization", "Bearer "+item.token)
+		if item.contentType != "" {
+			r.Header.Set("Content-Type", item.contentType)
+		}
+
+		request, err := parseAPIRequest(r, item.apiToken)
+		if item.errText != "" {
+			status := http.StatusBadRequest
+			if httpErr, ok := err.(apiHTTPError); ok {
+				status = httpErr.status
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), item.errText) || status != item.errStatus {
+				t.Errorf("Failing for %d\nexpected error: %d %q, real: %d %v", i, item.errStatus, item.errText, status, err)
+			}
+			continue
+		}
+
+		if err != nil ||
+			request.To != item.request.To ||
+			request.Text != item.request.Text ||
+			request.Format != item.request.Format ||
+			request.fileName != item.request.fileName ||
+			!bytes.Equal(request.fileData, item.request.fileData) {
+			t.Errorf("Failing for %d\nexpected: %#v, real: %#v, %v", i, item.request, request, err)
+		}
+	}
+}
+
+func Test_apiSend(t *testing.T) {
+	users := Users{
+		list: map[int]*User{
+			1: {UserID: 1, UserName: "user", PrivateChatID: 11},
+			2: {UserID: 2, UserName: "no_chat"},
+		},
+	}
+
+	data := []struct {
+		request     apiRequest
+		chatID      int
+		messageType int8
+		errText     string
+	}{
+		{request: apiRequest{To: "@user", Text: "hello"}, chatID: 11, messageType: msgIsText},
+		{request: apiRequest{To: "1", Text: "hello"}, chatID: 11, messageType: msgIsText},
+		{request: apiRequest{To: "-100123", Text: "hello"}, chatID: -100123, messageType: msgIsText},
+		{request: apiRequest{To: "@user", fileName: "log.txt", fileData: []byte("log")}, chatID: 11, messageType: msgIsDocument},
+		{request: apiRequest{To: "@user", fileName: "1.png", fileData: []byte("\x89PNG\x0D\x0A\x1A\x0A")}, chatID: 11, messageType: msgIsPhoto},
+		{request: apiRequest{To: "@no_chat", Text: "hello"}, errText: "user @no_chat has no private chat with bot"},
+		{request: apiRequest{To: "@unknown", Text: "hello"}, errText: "user @unknown not found"},
+	}
+
+	for i, item := range data {
+		messageSignal := make(chan BotMessage, 1)
+		err := apiSend(users, messageSignal, item.request)
+		if item.errText != "" {
+			if err == nil || err.Error() != item.errText {
+				t.Errorf("Failing for %d\nexpected error: %q, real: %v", i, item.errText, err)
+			}
+			continue
+		}
+
+		message := <-messageSignal
+		if err != nil || message.chatID != item.chatID || message.messageType != item.messageType {
+			t.Errorf("Failing for %d\nexpected: %d/%d, real: %d/%d, %v", i, item.chatID, item.messageType, message.chatID, message.messageType, err)
+		}
+	}
+}
+
+func Test_apiSendHandler(t *testing.T) {
+	users := Users{list: map[int]*User{1: {UserID: 1, UserName: "user", PrivateChatID: 11}}}
+	apiSignal := make(chan apiRequest)
+	messageSignal := make(chan BotMessage, 1)
+	go func() {
+		for request := range apiSignal {
+			request.result <- apiSend(users, messageSignal, request)
+		}
+	}()
+	defer close(apiSignal)
+
+	data := []struct {
+		to     string
+		status int
+		ok     bool
+	}{
+		{"@user", http.StatusOK, true},
+		{"@unknown", http.StatusNotFound, false},
+	}
+
+	handler := apiSendHandler("secret", apiSignal)
+	for _, item := range data {
+		r := httptest.NewRequest("POST", apiSendPath, strings.NewReader(`{"to": "`+item.to+`", "text": "hello"}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		response := struct {
+			Ok bool `json:"ok"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != item.status || response.Ok != item.ok {
+			t.Errorf("Failing for %s\nexpected: %d/%v, real: %d/%v, %v", item.to, item.status, item.ok, w.Code, response.Ok, err)
+		}
+		if item.ok {
+			if message := <-messageSignal; message.chatID != 11 || string(message.message) != "hello" {
+				t.Errorf("Failing for %s: message %#v", item.to, message)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// argStdinName - name of argument for validate whole user text (for commands without :vars)
+const argStdinName = "STDIN"
+
+// argCheck - validation rules for one command argument
+type argCheck struct {
+	re       string   // argument must match regexp (/cmd:vars=NAME:re=NAME=^[a-z]+$)
+	isInt    bool     // argument must be integer in range (/cmd:vars=SLEEP:int=SLEEP=1,3600)
+	min, max int      // -//-
+	choices  []string // argument must be one of (/cmd:vars=ACTION:enum=ACTION=start,stop)
+	maxLen   int      // max length of argument in characters (/cmd:vars=MSG:maxlen=MSG=100)
+}
+
+// parseArgCheck - parse argument validation modificator (re, int, enum, maxlen) in "NAME=rule" form
+func parseArgCheck(command *Command, kind, value string) error {
+	name, rule := splitStringHalfBy(value, "=")
+	if name == "" || !strings.Contains(value, "=") || rule == "" {
+		return fmt.Errorf("error: %s must be in NAME=rule form: %s", kind, value)
+	}
+
+	if command.argChecks == nil {
+		command.argChecks = map[string]argCheck{}
+	}
+	check := command.argChecks[name]
+
+	switch kind {
+	case "re":
+		if _, err := regexp.Compile(rule); err != nil {
+			return fmt.Errorf("error: invalid regexp for %s: %s", name, err)
+		}
+		check.re = rule
+	case "int":
+		minRaw, maxRaw := splitStringHalfBy(rule, ",")
+		minValue, errMin := strconv.Atoi(minRaw)
+		maxValue, errMax := strconv.Atoi(maxRaw)
+		if errMin != nil || errMax != nil || minValue > maxValue {
+			return fmt.Errorf("error: int must be in NAME=min,max form: %s", value)
+		}
+		check.isInt, check.min, check.max = true, minValue, maxValue
+	case "enum":
+		check.choices = regexp.MustCompile(",").Split(rule, -1)
+	case "maxlen":
+		maxLen, err := strconv.Atoi(rule)
+		if err != nil || maxLen <= 0 {
+			return fmt.Errorf("error: maxlen must be positive number: %s", value)
+		}
+		check.maxLen = maxLen
+	}
+
+	command.argChecks[name] = check
+	return nil
+}
+
+// checkArgNames - check that validated arguments are defined in :vars (or STDIN for commands without vars)
+func checkArgNames(command Command) error {
+	for name := range command.argChecks {
+		if len(command.vars) == 0 && name != argStdinName {
+			return fmt.Errorf("error: argument %s for validation must be %s for command without vars", name, argStdinName)
+		}
+		if len(command.vars) > 0 && !stringInList(name, command.vars) {
+			return fmt.Errorf("error: argument %s for validation is not defined in vars", name)
+		}
+	}
+
+	return nil
+}
+
+// splitArgs - split user input to command arguments: by vars or whole input as STDIN
+func splitArgs(input string, varsNames []string) map[string]string {
+	if len(varsNames) == 0 {
+		return map[string]string{argStdinName: input}
+	}
+
+	result := map[string]string{}
+	if input != "" {
+		arguments := regexp.MustCompile(`\s+`).Split(input, len(varsNames))
+		for i, arg := range arguments {
+			result[varsNames[i]] = arg
+		}
+	}
+
+	return result
+}
+
+// checkArgs - validate user input by command rules, returns usage message if input is not valid
+func checkArgs(path string, command Command, input string) (usageMsg string) {
+	if len(command.argChecks) == 0 {
+		return ""
+	}
+
+	args := splitArgs(input, command.vars)
+	names := []string{}
+	for name := range command.argChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errors := []string{}
+	for _, name := range names {
+		if err := command.argChecks[name].check(args[name]); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errors) == 0 {
+		return ""
+	}
+
+	usageMsg = "Usage: " + path
+	if len(command.vars) > 0 {
+		usageMsg += " " + strings.Join(command.vars, " ")
+	}
+	return usageMsg + "\n" + strings.Join(errors, "\n")
+}
+
+// check - validate one argument
+func (check argCheck) check(value string) error {
+	if check.maxLen > 0 && utf8.RuneCountInString(value) > check.maxLen {
+		return fmt.Errorf("must be no longer than %d characters", check.maxLen)
+	}
+
+	if check.isInt {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < check.min || number > check.max {
+			return fmt.Errorf("must be integer in range %d..%d", check.min, check.max)
+		}
+	}
+
+	if len(check.choices) > 0 && !stringInList(value, check.choices) {
+		return fmt.Errorf("must be one of: %s", strings.Join(check.choices, ", "))
+	}
+
+	if check.re != "" && !regexp.MustCompile(check.re).MatchString(value) {
+		return fmt.Errorf("must match %s", check.re)
+	}
+
+	return nil
+}
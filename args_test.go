@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_checkArgs(t *testing.T) {
+	_, command, err := parseBotCommand("/alarm:vars=SLEEP,ACTION,MSG:int=SLEEP=1,3600:enum=ACTION=start,stop:maxlen=MSG=10:re=MSG=^[a-z ]*$", "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkArgNames(command); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []struct {
+		input    string
+		usageMsg string
+	}{
+		{"10 start hello", ""},
+		{"3600 stop", ""},
+		{"", "Usage: /alarm SLEEP ACTION MSG\nACTION: must be one of: start, stop\nSLEEP: must be integer in range 1..3600"},
+		{"0 start", "Usage: /alarm SLEEP ACTION MSG\nSLEEP: must be integer in range 1..3600"},
+		{"1 restart", "Usage: /alarm SLEEP ACTION MSG\nACTION: must be one of: start, stop"},
+		{"1 start hello world!", "Usage: /alarm SLEEP ACTION MSG\nMSG: must be no longer than 10 characters"},
+		{"1 start $(rm -rf)", "Usage: /alarm SLEEP ACTION MSG\nMSG: must match ^[a-z ]*$"},
+	}
+
+	for _, item := range data {
+		if usageMsg := checkArgs("/alarm", command, item.input); usageMsg != item.usageMsg {
+			t.Errorf("Failing for %q\nexpected: %q\nreal: %q", item.input, item.usageMsg, usageMsg)
+		}
+	}
+
+	_, command, _ = parseBotCommand("/sort:maxlen=STDIN=5", "sort")
+	if usageMsg := checkArgs("/sort", command, "123456"); usageMsg != "Usage: /sort\nSTDIN: must be no longer than 5 characters" {
+		t.Errorf("checkArgs() for STDIN failed: %q", usageMsg)
+	}
+}
+
+func Test_parseArgCheckErrors(t *testing.T) {
+	invalidPaths := []string{
+		"/cmd:re=NAME",
+		"/cmd:re=NAME=",
+		"/cmd:re==abc",
+		"/cmd:re=NAME=[a-",
+		"/cmd:int=NAME=1",
+		"/cmd:int=NAME=10,1",
+		"/cmd:int=NAME=a,b",
+		"/cmd:maxlen=NAME=0",
+		"/cmd:maxlen=NAME=abc",
+	}
+	for _, path := range invalidPaths {
+		if _, _, err := parseBotCommand(path, "ls"); err == nil {
+			t.Errorf("Failing check invalid path for: %s", path)
+		}
+	}
+
+	names := []string{
+		"/cmd:vars=A:re=B=^a$",
+		"/cmd:re=A=^a$",
+	}
+	for _, path := range names {
+		_, command, err := parseBotCommand(path, "ls")
+		if err != nil || checkArgNames(command) == nil {
+			t.Errorf("Failing check argument names for: %s", path)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msoap/raphanus"
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// menuSubCommands - /shell2telegram and ctl sub-commands which change commands or root users in bot menu
+var menuSubCommands = map[string]bool{"rm": true, "auth": true, "ban": true, "add": true}
+
+// Bot - core of bot: routing of updates to commands, sending of messages via transport, timers,
+// users and commands are changed only in Run loop, other goroutines send requests via channels
+type Bot struct {
+	transport        Transport
+	appConfig        *Config
+	commands         Commands
+	users            Users
+	messageSignal    chan BotMessage
+	exitSignal       chan struct{}
+	reloadSignal     chan struct{}
+	apiSignal        chan apiRequest
+	ctlSignal        chan ctlRequest
+	menuSignal       chan botMenu
+	lastMenu         botMenu
+	cache            raphanus.DB
+	callbacks        *Callbacks
+	jobs             *Jobs
+	oneThreadMutex   sync.Mutex
+	internalCommands map[string]func(Ctx) string // all /shell2telegram sub-commands handlers
+	ctlCommands      map[string]func(Ctx) string // sub-commands of shell2telegram ctl, in addition to /shell2telegram sub-commands
+	reloadConfig     func(current Config) (Commands, Config, error)
+}
+
+// NewBot - create bot with commands and config, which works via transport
+func NewBot(transport Transport, commands Commands, appConfig *Config) *Bot {
+	return &Bot{
+		transport:     transport,
+		appConfig:     appConfig,
+		commands:      commands,
+		users:         NewUsers(*appConfig),
+		messageSignal: make(chan BotMessage, MessagesQueueSize),
+		exitSignal:    make(chan struct{}),
+		reloadSignal:  make(chan struct{}),
+		apiSignal:     make(chan apiRequest),
+		ctlSignal:     make(chan ctlRequest),
+		menuSignal:    make(chan botMenu, 1),
+		lastMenu:      botMenu{},
+		// cache may be enabled for each command, so create it always
+		cache:     raphanus.New(),
+		callbacks: NewCallbacks(),
+		jobs:      NewJobs(),
+		internalCommands: map[string]func(Ctx) string{
+			"stat":              cmdShell2telegramStat,
+			"ban":               cmdShell2telegramBan,
+			"search":            cmdShell2telegramSearch,
+			"desc":              cmdShell2telegramDesc,
+			"rm":                cmdShell2telegramRm,
+			"exit":              cmdShell2telegramExit,
+			"version":           cmdShell2telegramVersion,
+			"broadcast_to_root": cmdShell2telegramBroadcastToRoot,
+			"message_to_user":   cmdShell2telegramMessageToUser,
+			"reload":            cmdShell2telegramReload,
+			"role":              cmdShell2telegramRole,
+			"unrole":            cmdShell2telegramUnrole,
+			"ps":                cmdShell2telegramPs,
+			"schedule":          cmdShell2telegramSchedule,
+			"auth":              cmdShell2telegramAuth,
+			"send":              cmdShell2telegramSend,
+		},
+		ctlCommands: map[string]func(Ctx) string{
+			"add": cmdShell2telegramAdd,
+		},
+		reloadConfig: reloadConfig,
+	}
+}
+
+// newCtx - context for handlers of commands from user in chat
+func (bot *Bot) newCtx(userID, chatID int) Ctx {
+	return Ctx{
+		appConfig:      bot.appConfig,
+		users:          &bot.users,
+		commands:       bot.commands,
+		userID:         userID,
+		allowExec:      bot.appConfig.allowAll || bot.users.IsAuthorized(userID),
+		messageSignal:  bot.messageSignal,
+		chatID:         chatID,
+		exitSignal:     bot.exitSignal,
+		reloadSignal:   bot.reloadSignal,
+		cache:          &bot.cache,
+		oneThreadMutex: &bot.oneThreadMutex,
+		callbacks:      bot.callbacks,
+		jobs:           bot.jobs,
+		transport:      bot.transport,
+	}
+}
+
+// Run - main loop of bot: process updates from transport, send messages, requests from API and ctl, timers,
+// returns after exit signal (/shell2telegram exit or Ctrl-C)
+func (bot *Bot) Run(systemExitSignal, systemReloadSignal <-chan os.Signal) {
+	vacuumTicker := time.NewTicker(SecondsForOldUsersBeforeVacuum * time.Second)
+	defer vacuumTicker.Stop()
+	scheduleTicker := time.NewTicker(SecondsForScheduleCheck * time.Second)
+	defer scheduleTicker.Stop()
+	saveToBDTicker := make(<-chan time.Time)
+	if bot.appConfig.persistentUsers {
+		ticker := time.NewTicker(SecondsForAutoSaveUsersToDB * time.Second)
+		defer ticker.Stop()
+		saveToBDTicker = ticker.C
+	}
+
+	go publishBotMenu(bot.transport, bot.menuSignal)
+	defer close(bot.menuSignal)
+	bot.updateMenu()
+
+	for {
+		select {
+		case update := <-bot.transport.Updates():
+			bot.handleUpdate(update)
+
+		case botMessage := <-bot.messageSignal:
+			bot.send(botMessage)
+
+		case request := <-bot.apiSignal:
+			request.result <- apiSend(bot.users, bot.messageSignal, request)
+
+		case request := <-bot.ctlSignal:
+			request.result <- bot.handleCtl(request.command)
+
+		case <-saveToBDTicker:
+			bot.users.SaveToDB(bot.appConfig.usersDB)
+
+		case <-vacuumTicker.C:
+			bot.users.ClearOldUsers()
+			bot.callbacks.ClearOld()
+
+		case now := <-scheduleTicker.C:
+			bot.runSchedules(now)
+
+		case <-systemExitSignal:
+			go func() {
+				bot.exitSignal <- struct{}{}
+			}()
+
+		case <-systemReloadSignal:
+			go func() {
+				bot.reloadSignal <- struct{}{}
+			}()
+
+		case <-bot.reloadSignal:
+			bot.reload()
+
+		case <-bot.exitSignal:
+			if bot.appConfig.persistentUsers {
+				bot.users.needSaveDB = true
+				bot.users.SaveToDB(bot.appConfig.usersDB)
+			}
+			return
+		}
+	}
+}
+
+// handleUpdate - route update from user to command handler: button, inline query or message
+func (bot *Bot) handleUpdate(update Update) {
+	if query := update.CallbackQuery; query != nil {
+		if query.Message != nil {
+			bot.users.AddNew(tgbotapi.Message{From: query.From, Chat: query.Message.Chat})
+			cmdCallbackQuery(bot.newCtx(query.From.ID, query.Message.Chat.ID), query)
+		}
+		return
+	}
+
+	if query := update.InlineQuery; query.ID != "" {
+		bot.users.AddNew(tgbotapi.Message{From: query.From})
+		cmdInlineQuery(bot.newCtx(query.From.ID, 0), query)
+		return
+	}
+
+	bot.handleMessage(update.Message)
+}
+
+// handleMessage - run command from user message and send reply
+func (bot *Bot) handleMessage(message tgbotapi.Message) {
+	messageCmd, messageArgs, file, messageEnv := parseUserMessage(message, bot.commands)
+	allUserMessage := message.Text
+	if messageCmd != cmdPlainText && !strings.HasPrefix(allUserMessage, "/") {
+		// image, document, location, ...
+		allUserMessage = strings.TrimSpace(messageCmd + " " + messageArgs)
+	}
+
+	_, allowPlainText := bot.commands[cmdPlainText]
+	if len(messageCmd) == 0 || messageCmd == cmdPlainText && !allowPlainText {
+		return
+	}
+
+	userID := message.From.ID
+	rootChatID := bot.users.RootChatID(userID)
+	bot.users.AddNew(message)
+	ctx := bot.newCtx(userID, message.Chat.ID)
+	ctx.messageCmd, ctx.messageArgs, ctx.file, ctx.messageEnv = messageCmd, messageArgs, file, messageEnv
+	ctx.messageID = message.MessageID
+	allowExec := ctx.allowExec
+	_, isUserCmd := bot.commands[messageCmd]
+
+	replayMsg, menuChanged := "", false
+	switch {
+	// commands .................................
+	case !bot.appConfig.isPublicBot && (messageCmd == "/auth" || messageCmd == "/authroot"):
+		replayMsg = cmdAuth(ctx)
+
+	case messageCmd == "/help":
+		replayMsg = cmdHelp(ctx)
+
+	case messageCmd == "/shell2telegram" && bot.users.IsRoot(userID):
+		var messageSubCmd string
+		messageSubCmd, ctx.messageArgs = splitStringHalfBySpace(messageArgs)
+		if cmdHandler, ok := bot.internalCommands[messageSubCmd]; ok {
+			replayMsg = cmdHandler(ctx)
+			menuChanged = menuSubCommands[messageSubCmd]
+		} else {
+			replayMsg = "Sub-command not found"
+		}
+
+	// built-in commands for jobs, if they are not defined by user
+	case allowExec && messageCmd == "/jobs" && !isUserCmd:
+		replayMsg = cmdJobs(ctx)
+
+	case allowExec && messageCmd == "/kill" && !isUserCmd:
+		replayMsg = cmdKill(ctx)
+
+	case allowExec && (allowPlainText && messageCmd == cmdPlainText || messageCmd[0] == '/'):
+		cmdUser(ctx)
+
+	} // switch for commands
+
+	if bot.appConfig.logCommands {
+		log.Printf("%s: %s", bot.users.String(userID), allUserMessage)
+	}
+
+	sendMessage(bot.messageSignal, message.Chat.ID, []byte(replayMsg), "")
+	// root users are changed by /authroot or on first message of root from -root-users
+	if menuChanged || bot.users.RootChatID(userID) != rootChatID {
+		bot.updateMenu()
+	}
+}
+
+// send - send message via transport, ID of sent text message is returned to sender if it waits for it
+func (bot *Bot) send(botMessage BotMessage) {
+	messageID, err := sendToTransport(bot.transport, botMessage)
+	if botMessage.sentID != nil {
+		botMessage.sentID <- messageID
+	}
+	if err != nil {
+		log.Printf("failed to send message: %s", err)
+	}
+}
+
+// handleCtl - run sub-command from shell2telegram ctl
+func (bot *Bot) handleCtl(command string) (result string) {
+	subCmd, subArgs := splitStringHalfBySpace(command)
+	ctx := bot.newCtx(0, 0)
+	ctx.messageArgs = subArgs
+	cmdHandler, ok := bot.internalCommands[subCmd]
+	if !ok {
+		cmdHandler, ok = bot.ctlCommands[subCmd]
+	}
+	if ok {
+		result = cmdHandler(ctx)
+	} else {
+		result = "Sub-command not found"
+	}
+	if bot.appConfig.logCommands {
+		log.Printf("ctl: %s", command)
+	}
+	if menuSubCommands[subCmd] {
+		bot.updateMenu()
+	}
+
+	return result
+}
+
+// runSchedules - run commands which are due by schedule
+func (bot *Bot) runSchedules(now time.Time) {
+	for _, schedule := range bot.users.DueSchedules(now) {
+		runSchedule(bot.newCtx(0, 0), schedule, bot.users.ScheduleChatIDs(schedule))
+	}
+}
+
+// reload - reload config and commands, already running commands use old config and commands
+func (bot *Bot) reload() {
+	newCommands, newConfig, err := bot.reloadConfig(*bot.appConfig)
+	if err != nil {
+		log.Printf("reload config failed: %s", err)
+		bot.users.BroadcastForRoots(bot.messageSignal, fmt.Sprintf("Reload config failed: %s", err), 0)
+		return
+	}
+
+	reloadReport := "Config reloaded, " + commandsDiff(bot.commands, newCommands)
+	bot.commands, bot.appConfig = newCommands, &newConfig
+	bot.users.UpdatePredefinedUsers(*bot.appConfig)
+	bot.users.SetConfigSchedules(bot.appConfig.schedules)
+	bot.updateMenu()
+	log.Print(reloadReport)
+	bot.users.BroadcastForRoots(bot.messageSignal, reloadReport, 0)
+}
+
+// updateMenu - publish bot menu if it was changed, menu is updated on start and when commands or root users are changed
+func (bot *Bot) updateMenu() {
+	if bot.appConfig.noMenu {
+		return
+	}
+	menu := getBotMenu(bot.commands, bot.users, *bot.appConfig)
+	if changed, removed := menu.diff(bot.lastMenu); len(changed) > 0 || len(removed) > 0 {
+		bot.lastMenu = menu
+		// not published menu is replaced by the last one
+		select {
+		case <-bot.menuSignal:
+		default:
+		}
+		bot.menuSignal <- menu
+	}
+}
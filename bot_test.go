@@ -0,0 +1,367 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// startTestBot - run bot with fake transport, stop() waits for the end of main loop
+func startTestBot(t *testing.T, commandsRaw map[string]string, appConfig Config) (transport *fakeTransport, bot *Bot, stop func()) {
+	t.Helper()
+	commands := Commands{}
+	for pathRaw, shellCmd := range commandsRaw {
+		path, command, err := parseBotCommand(pathRaw, shellCmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands[path] = command
+	}
+	appConfig.shell = "sh"
+
+	transport = newFakeTransport()
+	bot = NewBot(transport, commands, &appConfig)
+	done := make(chan struct{})
+	go func() {
+		bot.Run(nil, nil)
+		close(done)
+	}()
+
+	return transport, bot, func() {
+		bot.exitSignal <- struct{}{}
+		<-done
+	}
+}
+
+// messagesByChat - text of messages from bot by chat ID
+func messagesByChat(messages []BotMessage) map[int]string {
+	result := map[int]string{}
+	for _, message := range messages {
+		result[message.chatID] += message.message
+	}
+	return result
+}
+
+func Test_BotAuth(t *testing.T) {
+	transport, _, stop := startTestBot(t,
+		map[string]string{"/hello": "echo hello $S2T_LOGIN"},
+		Config{predefinedRootUsers: []string{"root_user"}, noMenu: true},
+	)
+	defer stop()
+
+	transport.sendText(1, "root_user", "/help")
+	if message := transport.waitMessage(t); message.chatID != 1 || !strings.Contains(message.message, "/hello → echo hello $S2T_LOGIN") {
+		t.Errorf("1. /help for root failed: %#v", message)
+	}
+
+	// not authorized user can't run commands and doesn't see them in /help
+	transport.sendText(2, "user2", "/hello")
+	transport.sendText(2, "user2", "/help")
+	if message := transport.waitMessage(t); message.chatID != 2 || strings.Contains(message.message, "/hello") || !strings.Contains(message.message, "/auth [code] → authorize user") {
+		t.Errorf("2. /help for not authorized user failed: %#v", message)
+	}
+
+	// code is sent to root users
+	transport.sendText(2, "user2", "/auth")
+	messages := messagesByChat(transport.waitMessages(t, 2))
+	if !strings.HasPrefix(messages[2], "See code in terminal with shell2telegram") {
+		t.Errorf("3. /auth failed: %#v", messages)
+	}
+	code := regexp.MustCompile(`^Request access for user2  \(@user2\)\. Code: (\S+)\n$`).FindStringSubmatch(messages[1])
+	if len(code) != 2 {
+		t.Fatalf("3. /auth failed, code is not sent to root: %#v", messages)
+	}
+
+	transport.sendText(2, "user2", "/auth wrong")
+	if message := transport.waitMessage(t); message.message != "Code is not valid." {
+		t.Errorf("4. /auth with wrong code failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "/auth "+code[1])
+	if message := transport.waitMessage(t); message.message != "You (user2  (@user2)) authorized." {
+		t.Errorf("5. /auth with code failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "/hello")
+	if message := transport.waitMessage(t); message.chatID != 2 || message.message != "hello user2\n" {
+		t.Errorf("6. command of authorized user failed: %#v", message)
+	}
+
+	// sub-commands of /shell2telegram only for root
+	transport.sendText(2, "user2", "/shell2telegram stat")
+	transport.sendText(1, "root_user", "/shell2telegram stat")
+	if message := transport.waitMessage(t); message.chatID != 1 || !strings.Contains(message.message, "(@user2): id: 2, auth: true, root: false") {
+		t.Errorf("7. /shell2telegram stat failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "/authroot")
+	messages = messagesByChat(transport.waitMessages(t, 2))
+	code = regexp.MustCompile(`^Request root access for user2  \(@user2\)\. Code: (\S+)\n$`).FindStringSubmatch(messages[1])
+	if len(code) != 2 {
+		t.Fatalf("8. /authroot failed, code is not sent to root: %#v", messages)
+	}
+	transport.sendText(2, "user2", "/authroot "+code[1])
+	if message := transport.waitMessage(t); message.message != "You (user2  (@user2)) authorized as root." {
+		t.Errorf("9. /authroot with code failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "/shell2telegram version")
+	if message := transport.waitMessage(t); message.chatID != 2 || message.message != "shell2telegram "+version {
+		t.Errorf("10. /shell2telegram for new root failed: %#v", message)
+	}
+}
+
+func Test_BotShell2telegram(t *testing.T) {
+	transport, _, stop := startTestBot(t,
+		map[string]string{"/hello": "echo hello", "/date": "echo 2020-01-01"},
+		Config{predefinedRootUsers: []string{"root_user"}, predefinedAllowedUsers: []string{"user2"}},
+	)
+	defer stop()
+
+	transport.sendText(1, "root_user", "/help")
+	transport.sendText(2, "user2", "/help")
+	transport.waitMessages(t, 2)
+	transport.waitMenu(t, BotCommandScope{Type: "chat", ChatID: 1}, func(commands []BotCommand) bool {
+		return len(commands) > 0 && commands[0].Command == "auth"
+	})
+
+	data := []struct {
+		userID  int
+		command string
+		reply   string
+	}{
+		{1, "/shell2telegram version", "shell2telegram " + version},
+		{1, "/shell2telegram", "Sub-command not found"},
+		{1, "/shell2telegram unknown", "Sub-command not found"},
+		{1, "/shell2telegram rm", "Please set command for delete: /shell2telegram rm </command>"},
+		{1, "/shell2telegram rm /hello", "Deleted command: /hello"},
+		{1, "/shell2telegram rm /hello", "Command /hello not found"},
+		{2, "/hello", ""},
+		{2, "/shell2telegram ban user2", ""},
+		{2, "/date", "2020-01-01\n"},
+		{1, "/shell2telegram ban user2", "User user2  (@user2) banned"},
+		{2, "/date", ""},
+		{1, "/shell2telegram ban user3", "User not found"},
+		{1, "/date", "2020-01-01\n"},
+	}
+
+	for i, item := range data {
+		// commands without reply are checked by the next command with reply
+		transport.sendText(item.userID, "", item.command)
+		if item.reply == "" {
+			continue
+		}
+		if message := transport.waitMessage(t); message.chatID != item.userID || message.message != item.reply {
+			t.Errorf("%d. %s failed: %#v, expected: %q", i+1, item.command, message, item.reply)
+		}
+	}
+
+	transport.waitMenu(t, BotCommandScope{Type: "default"}, func(commands []BotCommand) bool {
+		for _, command := range commands {
+			if command.Command == "hello" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func Test_BotCmdUser(t *testing.T) {
+	transport, _, stop := startTestBot(t,
+		map[string]string{
+			"/cat":             "cat",
+			"/long":            "seq 1 2000",
+			"/restart:confirm": "echo restarted",
+			"/:document":       `cat "$S2T_FILE_PATH"`,
+			"/:plain_text":     "tr a-z A-Z",
+		},
+		Config{predefinedAllowedUsers: []string{"user2"}, noMenu: true, confirmTimeout: DefaultConfirmTimeout},
+	)
+	defer stop()
+	transport.files["file1"] = "file content"
+
+	transport.sendText(2, "user2", "/cat some text")
+	if message := transport.waitMessage(t); message.chatID != 2 || message.message != "some text" {
+		t.Errorf("1. command with arguments failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "plain text")
+	if message := transport.waitMessage(t); message.message != "PLAIN TEXT" {
+		t.Errorf("2. command for plain text failed: %#v", message)
+	}
+
+	transport.sendText(2, "user2", "/jobs")
+	if message := transport.waitMessage(t); message.message != "No running commands" {
+		t.Errorf("3. /jobs failed: %#v", message)
+	}
+
+	// long output is split to messages
+	transport.sendText(2, "user2", "/long")
+	output, count := "", 0
+	for !strings.HasSuffix(output, "\n2000\n") {
+		message := transport.waitMessage(t)
+		if len([]rune(message.message)) > MaxMessageLength {
+			t.Errorf("4. message is too long: %d", len(message.message))
+		}
+		output += strings.TrimSpace(message.message) + "\n"
+		count++
+	}
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); count < 3 || len(lines) != 2000 || lines[1999] != "2000" {
+		t.Errorf("4. long output failed: %d messages, %d lines", count, len(lines))
+	}
+
+	transport.updates <- Update{Update: tgbotapi.Update{Message: tgbotapi.Message{
+		From:     tgbotapi.User{ID: 2, UserName: "user2"},
+		Chat:     tgbotapi.Chat{ID: 2, Type: "private"},
+		Document: tgbotapi.Document{FileID: "file1", FileName: "file.txt"},
+	}}}
+	if message := transport.waitMessage(t); message.message != "file content" {
+		t.Errorf("5. command for document failed: %#v", message)
+	}
+
+	// confirmation via inline button
+	transport.sendText(2, "user2", "/restart")
+	confirm := transport.waitMessage(t)
+	keyboard, ok := confirm.replyMarkup.(InlineKeyboardMarkup)
+	if !ok || confirm.message != "Run /restart?" || len(keyboard.InlineKeyboard) != 1 || len(keyboard.InlineKeyboard[0]) != 2 {
+		t.Fatalf("6. confirmation failed: %#v", confirm)
+	}
+
+	transport.updates <- Update{CallbackQuery: &CallbackQuery{
+		ID:      "query1",
+		From:    tgbotapi.User{ID: 2, UserName: "user2"},
+		Message: &tgbotapi.Message{MessageID: confirm.messageID, Chat: tgbotapi.Chat{ID: 2, Type: "private"}},
+		Data:    keyboard.InlineKeyboard[0][0].CallbackData,
+	}}
+	messages := []string{}
+	for _, message := range transport.waitMessages(t, 3) {
+		messages = append(messages, message.message)
+	}
+	sort.Strings(messages)
+	if strings.Join(messages, "|") != "|Confirmed: /restart|restarted\n" {
+		t.Errorf("7. run confirmed command failed: %#v", messages)
+	}
+
+	transport.updates <- Update{CallbackQuery: &CallbackQuery{
+		ID:      "query2",
+		From:    tgbotapi.User{ID: 2, UserName: "user2"},
+		Message: &tgbotapi.Message{MessageID: confirm.messageID, Chat: tgbotapi.Chat{ID: 2, Type: "private"}},
+		Data:    keyboard.InlineKeyboard[0][0].CallbackData,
+	}}
+	if message := transport.waitMessage(t); message.messageType != msgIsCallbackAnswer || message.callbackQueryID != "query2" {
+		t.Errorf("8. second press of button failed: %#v", message)
+	}
+}
+
+func Test_BotCtl(t *testing.T) {
+	transport, bot, stop := startTestBot(t, map[string]string{}, Config{predefinedRootUsers: []string{"root_user"}, noMenu: true})
+	defer stop()
+
+	transport.sendText(1, "root_user", "/help")
+	transport.waitMessage(t)
+
+	data := []struct {
+		command, result string
+	}{
+		{"version", "shell2telegram " + version},
+		{"add /hello echo hello", "Added command: /hello (until reload of config)"},
+		{"unknown", "Sub-command not found"},
+	}
+	for i, item := range data {
+		result := make(chan string)
+		bot.ctlSignal <- ctlRequest{command: item.command, result: result}
+		if got := <-result; got != item.result {
+			t.Errorf("%d. ctl %q failed: %q, expected: %q", i+1, item.command, got, item.result)
+		}
+	}
+
+	transport.sendText(1, "root_user", "/hello")
+	if message := transport.waitMessage(t); message.message != "hello\n" {
+		t.Errorf("command added via ctl failed: %#v", message)
+	}
+}
+
+func Test_BotConfirmWithFile(t *testing.T) {
+	transport, _, stop := startTestBot(t,
+		map[string]string{"/wc:accept_file:confirm": `echo "file=[$(cat "$S2T_FILE_PATH")] message=$S2T_MESSAGE_ID"`},
+		Config{predefinedAllowedUsers: []string{"user2"}, noMenu: true, confirmTimeout: DefaultConfirmTimeout},
+	)
+	defer stop()
+	transport.files["file1"] = "file content"
+
+	transport.updates <- Update{Update: tgbotapi.Update{Message: tgbotapi.Message{
+		MessageID: 10,
+		From:      tgbotapi.User{ID: 2, UserName: "user2"},
+		Chat:      tgbotapi.Chat{ID: 2, Type: "private"},
+		Document:  tgbotapi.Document{FileID: "file1", FileName: "file.txt"},
+		Caption:   "/wc",
+	}}}
+	confirm := transport.waitMessage(t)
+	keyboard, ok := confirm.replyMarkup.(InlineKeyboardMarkup)
+	if !ok || confirm.message != "Run /wc?" {
+		t.Fatalf("confirmation failed: %#v", confirm)
+	}
+
+	// file from user message is used after confirmation
+	transport.updates <- Update{CallbackQuery: &CallbackQuery{
+		ID:      "query1",
+		From:    tgbotapi.User{ID: 2, UserName: "user2"},
+		Message: &tgbotapi.Message{MessageID: confirm.messageID, Chat: tgbotapi.Chat{ID: 2, Type: "private"}},
+		Data:    keyboard.InlineKeyboard[0][0].CallbackData,
+	}}
+	messages := []string{}
+	for _, message := range transport.waitMessages(t, 3) {
+		messages = append(messages, message.message)
+	}
+	sort.Strings(messages)
+	if strings.Join(messages, "|") != "|Confirmed: /wc|file=[file content] message=10\n" {
+		t.Errorf("run confirmed command with file failed: %#v", messages)
+	}
+}
+
+func Test_BotReloadUsers(t *testing.T) {
+	transport, bot, stop := startTestBot(t,
+		map[string]string{"/hello": "echo hello"},
+		Config{predefinedRootUsers: []string{"root_user"}, predefinedAllowedUsers: []string{"user2"}, noMenu: true},
+	)
+	defer stop()
+
+	for userID, userName := range map[int]string{1: "root_user", 2: "user2", 3: "user3"} {
+		transport.sendText(userID, userName, "/help")
+		transport.waitMessage(t)
+	}
+
+	// known users get or lose access after reload
+	bot.reloadConfig = func(current Config) (Commands, Config, error) {
+		_, command, _ := parseBotCommand("/hello", "echo hello")
+		return Commands{"/hello": command}, Config{predefinedRootUsers: []string{"user3"}, predefinedAllowedUsers: []string{"root_user"}, shell: "sh", noMenu: true}, nil
+	}
+	bot.reloadSignal <- struct{}{}
+	if message := transport.waitMessage(t); message.chatID != 3 || message.message != "Config reloaded, commands not changed" {
+		t.Errorf("1. reload report for new root failed: %#v", message)
+	}
+
+	data := []struct {
+		userID  int
+		command string
+		reply   string
+	}{
+		{2, "/hello", ""},
+		{1, "/shell2telegram version", ""},
+		{1, "/hello", "hello\n"},
+		{3, "/shell2telegram version", "shell2telegram " + version},
+	}
+	for i, item := range data {
+		// commands without reply are checked by the next command with reply
+		transport.sendText(item.userID, "", item.command)
+		if item.reply == "" {
+			continue
+		}
+		if message := transport.waitMessage(t); message.chatID != item.userID || message.message != item.reply {
+			t.Errorf("%d. %s failed: %#v, expected: %q", i+2, item.command, message, item.reply)
+		}
+	}
+}
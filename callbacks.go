@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// callbackAction - action for inline keyboard button, button contains only ID of action,
+// so user cannot forge command or arguments
+type callbackAction struct {
+	userID     int          // user who can press the button, 0 - any user in chat (buttons from command output)
+	chatID     int          // chat with button
+	command    string       // command for run
+	args       string       // command arguments
+	file       *messageFile // file from user message with command (for :confirm)
+	messageEnv []string     // environment variables from user message with command (for :confirm)
+	messageID  int          // ID of user message with command (for :confirm)
+	expireAt   time.Time    // for expire old actions
+}
+
+// Callbacks - actions for inline keyboard buttons by ID,
+// actions are added from main loop and from command goroutines (buttons in JSON output)
+type Callbacks struct {
+	mutex sync.Mutex
+	list  map[string]callbackAction
+}
+
+// NewCallbacks - create Callbacks object
+func NewCallbacks() *Callbacks {
+	return &Callbacks{list: map[string]callbackAction{}}
+}
+
+// Add - add new action which expires after ttl seconds, returns ID for callback data of button
+func (callbacks *Callbacks) Add(action callbackAction, ttl int) string {
+	callbacks.mutex.Lock()
+	defer callbacks.mutex.Unlock()
+
+	id := getRandomCode()
+	action.expireAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	callbacks.list[id] = action
+
+	return id
+}
+
+// Get - get not expired action by ID
+func (callbacks *Callbacks) Get(id string) (callbackAction, bool) {
+	callbacks.mutex.Lock()
+	defer callbacks.mutex.Unlock()
+
+	action, ok := callbacks.list[id]
+	if !ok || time.Now().After(action.expireAt) {
+		return callbackAction{}, false
+	}
+
+	return action, true
+}
+
+// Remove - remove action by ID
+func (callbacks *Callbacks) Remove(id string) {
+	callbacks.mutex.Lock()
+	defer callbacks.mutex.Unlock()
+
+	delete(callbacks.list, id)
+}
+
+// ClearOld - remove expired actions
+func (callbacks *Callbacks) ClearOld() {
+	callbacks.mutex.Lock()
+	defer callbacks.mutex.Unlock()
+
+	now := time.Now()
+	for id, action := range callbacks.list {
+		if now.After(action.expireAt) {
+			delete(callbacks.list, id)
+		}
+	}
+}
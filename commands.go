@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/msoap/raphanus"
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
 )
 
 // Ctx - context for bot command function (users, command, args, ...)
@@ -22,9 +26,69 @@ type Ctx struct {
 	messageSignal  chan<- BotMessage // for send telegram messages
 	chatID         int               // chat for send replay
 	exitSignal     chan<- struct{}   // for signal for terminate bot
+	reloadSignal   chan<- struct{}   // for signal for reload config and commands
 	cache          *raphanus.DB      // cache for commands output
 	cacheTTL       int               // cache timeout
 	oneThreadMutex *sync.Mutex       // mutex for run shell commands in one thread
+	callbacks      *Callbacks        // actions for inline keyboard buttons
+	isConfirmed    bool              // command confirmed by user via inline button
+	file           *messageFile      // file from user message (image, document, voice)
+	messageEnv     []string          // environment variables from user message (location, contact, ...)
+	messageID      int               // ID of user message, for reply to it
+	jobs           *Jobs             // running shell commands
+	transport      Transport         // for download files
+}
+
+// parseUserMessage - get command, arguments and attachments from user message
+func parseUserMessage(message tgbotapi.Message, commands Commands) (messageCmd, messageArgs string, file *messageFile, messageEnv []string) {
+	switch {
+	case len(message.Photo) > 0:
+		// the last photo is the biggest size
+		photo := message.Photo[len(message.Photo)-1]
+		messageCmd = cmdImage
+		file = &messageFile{fileID: photo.FileID, fileName: "image.jpg", mimeType: "image/jpeg", size: photo.FileSize}
+	case message.Document.FileID != "":
+		document := message.Document
+		messageCmd = cmdDocument
+		file = &messageFile{fileID: document.FileID, fileName: document.FileName, mimeType: document.MimeType, size: document.FileSize}
+	case message.Voice.FileID != "":
+		voice := message.Voice
+		messageCmd = cmdVoice
+		file = &messageFile{fileID: voice.FileID, fileName: "voice.ogg", mimeType: voice.MimeType, size: voice.FileSize}
+		messageEnv = []string{"S2T_DURATION=" + strconv.Itoa(voice.Duration)}
+	case message.Location.Latitude != 0 || message.Location.Longitude != 0:
+		messageCmd = cmdLocation
+		messageEnv = []string{
+			"S2T_LATITUDE=" + strconv.FormatFloat(float64(message.Location.Latitude), 'f', -1, 32),
+			"S2T_LONGITUDE=" + strconv.FormatFloat(float64(message.Location.Longitude), 'f', -1, 32),
+		}
+	case message.Contact.PhoneNumber != "":
+		messageCmd = cmdContact
+		messageEnv = []string{
+			"S2T_PHONE=" + message.Contact.PhoneNumber,
+			"S2T_CONTACT_FIRST_NAME=" + message.Contact.FirstName,
+			"S2T_CONTACT_LAST_NAME=" + message.Contact.LastName,
+			"S2T_CONTACT_USERID=" + strconv.Itoa(message.Contact.UserID),
+		}
+	case len(message.Text) > 0 && message.Text[0] == '/':
+		messageCmd, messageArgs = splitStringHalfBySpace(message.Text)
+		if strings.HasPrefix(messageCmd, "/:") {
+			// special commands only for messages with image, document, ...
+			messageCmd = ""
+		}
+	default:
+		messageCmd, messageArgs = cmdPlainText, message.Text
+	}
+
+	if file != nil {
+		// caption of file is arguments for special command or "/command args" for command with :accept_file
+		messageArgs = message.Caption
+		if captionCmd, captionArgs := splitStringHalfBySpace(messageArgs); commands[captionCmd].acceptFile {
+			messageCmd, messageArgs = captionCmd, captionArgs
+		}
+	}
+
+	return messageCmd, messageArgs, file, messageEnv
 }
 
 // /auth and /authroot - authorize users
@@ -68,12 +132,20 @@ func cmdHelp(ctx Ctx) (replayMsg string) {
 
 	if ctx.allowExec {
 		for cmd, shellCmdRow := range ctx.commands {
+			if !isAllowedCommand(ctx, shellCmdRow) {
+				continue
+			}
 			description := shellCmdRow.description
 			if description == "" {
 				description = shellCmdRow.shellCmd
 			}
 			helpMsg = append(helpMsg, cmd+" → "+description)
 		}
+		for cmd, description := range map[string]string{"/jobs": "list of your running commands", "/kill <job_id>": "stop running command"} {
+			if _, exists := ctx.commands[strings.Fields(cmd)[0]]; !exists {
+				helpMsg = append(helpMsg, cmd+" → "+description)
+			}
+		}
 	}
 	sort.Strings(helpMsg)
 
@@ -86,12 +158,19 @@ func cmdHelp(ctx Ctx) (replayMsg string) {
 
 	if ctx.users.IsRoot(ctx.userID) {
 		helpMsgForRoot := []string{
+			"/shell2telegram auth <user_id|username> [root] → authorize user",
 			"/shell2telegram ban <user_id|username> → ban user",
 			"/shell2telegram broadcast_to_root <message> → send message to all root users in private chat",
 			"/shell2telegram desc <bot description> → set bot description",
 			"/shell2telegram message_to_user <user_id|username> <message> → send message to user in private chat",
+			"/shell2telegram reload → reload commands and settings from config",
 			"/shell2telegram rm </command> → delete command",
+			"/shell2telegram ps → list of running commands of all users",
+			"/shell2telegram role <user_id|username> <role> → assign role to user",
+			"/shell2telegram schedule list|add|rm|pause|resume → manage scheduled commands",
+			"/shell2telegram unrole <user_id|username> <role> → remove role from user",
 			"/shell2telegram search <query> → search users by name/id",
+			"/shell2telegram send <chat_id|user_id|username> <message> → send message to chat or user",
 			"/shell2telegram stat → get stat about users",
 			"/shell2telegram version → show version",
 		}
@@ -117,32 +196,279 @@ func cmdHelp(ctx Ctx) (replayMsg string) {
 
 // all commands from command-line
 func cmdUser(ctx Ctx) {
-	if cmd, found := ctx.commands[ctx.messageCmd]; found {
+	if cmd, found := ctx.commands[ctx.messageCmd]; found && isAllowedCommand(ctx, cmd) {
+		if usageMsg := checkArgs(ctx.messageCmd, cmd, ctx.messageArgs); usageMsg != "" {
+			sendMessage(ctx.messageSignal, ctx.chatID, []byte(usageMsg), "")
+			return
+		}
+		if cmd.confirm && !ctx.isConfirmed {
+			askConfirmation(ctx)
+			return
+		}
+
+		ctx.cacheTTL = commandOption(cmd.cache, ctx.appConfig.cache)
+		if ctx.file != nil || len(ctx.messageEnv) > 0 {
+			// output depends on file or location, don't cache it
+			ctx.cacheTTL = 0
+		}
+		shellUser := ctx.users.ShellUser(ctx.userID, ctx.chatID)
+		userString := ctx.users.String(ctx.userID)
+		rootChatIDs := []int{}
+		if cmd.onError == onErrorRoots {
+			rootChatIDs = ctx.users.RootChatIDs(ctx.userID)
+		}
+		if cmd.outputJSON {
+			// commands are checked for buttons in goroutine, but may be changed in main loop
+			ctx.commands = ctx.commands.copy()
+		}
+
 		go func() {
-			if ctx.appConfig.oneThread {
-				ctx.oneThreadMutex.Lock()
+			extraEnv := ctx.messageEnv
+			if ctx.messageID != 0 {
+				extraEnv = append(extraEnv, "S2T_MESSAGE_ID="+strconv.Itoa(ctx.messageID))
+			}
+			if ctx.file != nil {
+				filePath, err := ctx.transport.DownloadFile(*ctx.file, ctx.appConfig.maxFileSize)
+				if err != nil {
+					log.Printf("download file failed: %s", err)
+					sendMessage(ctx.messageSignal, ctx.chatID, []byte(fmt.Sprintf("Download file failed: %s", err)), "")
+					return
+				}
+				defer func() {
+					if err := os.Remove(filePath); err != nil {
+						log.Printf("remove temporary file failed: %s", err)
+					}
+				}()
+				extraEnv = append(extraEnv, ctx.file.env(filePath)...)
 			}
-			replayMsgRaw := execShell(
-				cmd.shellCmd,
-				ctx.messageArgs,
-				ctx.commands[ctx.messageCmd].vars,
-				ctx.userID,
-				ctx.chatID,
-				ctx.users.list[ctx.userID].UserName,
-				ctx.users.list[ctx.userID].FirstName+" "+ctx.users.list[ctx.userID].LastName,
-				ctx.cache,
-				ctx.cacheTTL,
-				ctx.appConfig,
-			)
-			if ctx.appConfig.oneThread {
-				ctx.oneThreadMutex.Unlock()
+
+			run := func(stream io.Writer) ([]byte, execStatus) {
+				job := Job{userID: ctx.userID, chatID: ctx.chatID, command: ctx.messageCmd, args: ctx.messageArgs}
+				return runJob(ctx, job, cmd, ctx.messageArgs, extraEnv, stream, shellUser)
+			}
+
+			if cmd.stream {
+				streamCommand(ctx, cmd, run)
+				return
 			}
 
-			sendMessage(ctx.messageSignal, ctx.chatID, replayMsgRaw, cmd.isMarkdown)
+			replayMsgRaw, status := run(nil)
+			if status.err == nil && cmd.onError != "" {
+				return
+			}
+			if status.err != nil && cmd.onError == onErrorRoots {
+				for _, chatID := range rootChatIDs {
+					sendMessage(ctx.messageSignal, chatID, []byte(fmt.Sprintf("%s: %s failed: %s", userString, ctx.messageCmd, status)), "")
+				}
+			}
+			sendCommandResult(ctx, cmd, replayMsgRaw, status)
 		}()
 	}
 }
 
+// sendCommandResult - send output of command with footer with exit status (for failed command or command with :status)
+func sendCommandResult(ctx Ctx, cmd Command, output []byte, status execStatus) {
+	if status.err == nil && !cmd.showStatus {
+		sendCommandOutput(ctx, cmd, output)
+		return
+	}
+
+	footer := status.String()
+	if messageType, _ := detectOutputFile(output); messageType != msgIsText || cmd.getFormat() != "" || cmd.asDocument || cmd.outputJSON {
+		// footer may break file or formatting
+		sendCommandOutput(ctx, cmd, output)
+		sendMessage(ctx.messageSignal, ctx.chatID, []byte(footer), "")
+		return
+	}
+
+	if outputText := strings.TrimRight(string(output), "\n"); outputText != "" {
+		footer = outputText + "\n\n" + footer
+	}
+	sendCommandOutput(ctx, cmd, []byte(footer))
+}
+
+// sendCommandOutput - send output of command as messages or as document
+func sendCommandOutput(ctx Ctx, cmd Command, output []byte) {
+	if cmd.outputJSON {
+		sendJSONOutput(ctx, output)
+		return
+	}
+
+	if !isDocumentOutput(cmd, output, ctx.appConfig.documentSize) {
+		sendMessage(ctx.messageSignal, ctx.chatID, output, cmd.getFormat())
+		return
+	}
+
+	fileName := cmd.docName
+	if fileName == "" {
+		fileName = DefaultDocumentName
+	}
+	caption := getOutputPreview(string(output), ctx.appConfig.documentPreview)
+	sendDocument(ctx.messageSignal, ctx.chatID, fileName, output, caption)
+}
+
+// /jobs - list of running commands of user
+func cmdJobs(ctx Ctx) (replayMsg string) {
+	jobs := ctx.jobs.List(ctx.userID)
+	if len(jobs) == 0 {
+		return "No running commands"
+	}
+
+	jobsMsg := []string{}
+	for _, job := range jobs {
+		jobsMsg = append(jobsMsg, job.String())
+	}
+	return strings.Join(jobsMsg, "\n")
+}
+
+// /kill <id> - stop running command, root users may stop commands of all users
+func cmdKill(ctx Ctx) (replayMsg string) {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(ctx.messageArgs), "#"))
+	if err != nil {
+		return "Usage: /kill <job_id>"
+	}
+
+	userID := ctx.userID
+	if ctx.users.IsRoot(ctx.userID) {
+		userID = 0
+	}
+	if err := ctx.jobs.Kill(id, userID); err != nil {
+		return err.Error()
+	}
+
+	return fmt.Sprintf("Job #%d stopped", id)
+}
+
+// askConfirmation - send inline buttons for confirm run of command
+func askConfirmation(ctx Ctx) {
+	id := ctx.callbacks.Add(callbackAction{
+		userID:     ctx.userID,
+		chatID:     ctx.chatID,
+		command:    ctx.messageCmd,
+		args:       ctx.messageArgs,
+		file:       ctx.file,
+		messageEnv: ctx.messageEnv,
+		messageID:  ctx.messageID,
+	}, ctx.appConfig.confirmTimeout)
+
+	confirmMessage := BotMessage{
+		chatID:      ctx.chatID,
+		messageType: msgIsText,
+		message:     fmt.Sprintf("Run %s?", strings.TrimSpace(ctx.messageCmd+" "+ctx.messageArgs)),
+		replyMarkup: InlineKeyboardMarkup{
+			InlineKeyboard: [][]InlineKeyboardButton{{
+				{Text: "Run", CallbackData: id + ":run"},
+				{Text: "Cancel", CallbackData: id + ":cancel"},
+			}},
+		},
+	}
+	go func() {
+		ctx.messageSignal <- confirmMessage
+	}()
+}
+
+// cmdCallbackQuery - user pressed inline keyboard button (Run/Cancel for commands with :confirm or button from JSON output)
+func cmdCallbackQuery(ctx Ctx, query *CallbackQuery) {
+	id, answer := splitStringHalfBy(query.Data, ":")
+	if answer == "cmd" {
+		cmdCallbackButton(ctx, query, id)
+		return
+	}
+
+	action, found := ctx.callbacks.Get(id)
+	answerText, editText := "", ""
+
+	switch {
+	case !found:
+		answerText, editText = "Confirmation expired", "Confirmation expired"
+	case action.userID != ctx.userID || action.chatID != ctx.chatID:
+		answerText = "This button is not for you"
+	case answer == "run" && ctx.allowExec:
+		ctx.callbacks.Remove(id)
+		ctx.messageCmd, ctx.messageArgs, ctx.isConfirmed = action.command, action.args, true
+		// command runs with attachments of user message, not of message with buttons
+		ctx.file, ctx.messageEnv, ctx.messageID = action.file, action.messageEnv, action.messageID
+		editText = fmt.Sprintf("Confirmed: %s", strings.TrimSpace(action.command+" "+action.args))
+		cmdUser(ctx)
+	case answer == "run":
+		answerText = "Access denied"
+	default:
+		ctx.callbacks.Remove(id)
+		editText = fmt.Sprintf("Cancelled: %s", strings.TrimSpace(action.command+" "+action.args))
+	}
+
+	messages := []BotMessage{{messageType: msgIsCallbackAnswer, callbackQueryID: query.ID, message: answerText}}
+	if editText != "" {
+		messages = append(messages, BotMessage{
+			messageType: msgIsEdit,
+			chatID:      ctx.chatID,
+			messageID:   query.Message.MessageID,
+			message:     editText,
+		})
+	}
+	go func() {
+		for _, message := range messages {
+			ctx.messageSignal <- message
+		}
+	}()
+}
+
+// cmdCallbackButton - user pressed button from JSON output of command, button may be pressed many times
+// by any user in chat, command is checked as typed by user
+func cmdCallbackButton(ctx Ctx, query *CallbackQuery, id string) {
+	action, found := ctx.callbacks.Get(id)
+	cmd, cmdFound := ctx.commands[action.command]
+	answerText := ""
+
+	switch {
+	case !found:
+		answerText = "Button expired"
+	case action.chatID != ctx.chatID:
+		answerText = "This button is not for you"
+	case !cmdFound:
+		answerText = "Command not found"
+	case !ctx.allowExec || !isAllowedCommand(ctx, cmd):
+		answerText = "Access denied"
+	default:
+		ctx.messageCmd, ctx.messageArgs = action.command, action.args
+		answerText = "Running " + strings.TrimSpace(action.command+" "+action.args)
+		cmdUser(ctx)
+	}
+
+	go func() {
+		ctx.messageSignal <- BotMessage{messageType: msgIsCallbackAnswer, callbackQueryID: query.ID, message: answerText}
+	}()
+}
+
+// isAllowedCommand - check access to command for current user in current chat,
+// root users are allowed to run all commands in allowed chats
+func isAllowedCommand(ctx Ctx, cmd Command) bool {
+	if len(cmd.allowChats) > 0 {
+		chatAllowed := false
+		for _, chatID := range cmd.allowChats {
+			if chatID == ctx.chatID {
+				chatAllowed = true
+				break
+			}
+		}
+		if !chatAllowed {
+			return false
+		}
+	}
+
+	if ctx.users.IsRoot(ctx.userID) {
+		return true
+	}
+	if cmd.rootOnly {
+		return false
+	}
+	if len(cmd.allowUsers) > 0 || len(cmd.allowRoles) > 0 {
+		return ctx.users.InList(ctx.userID, cmd.allowUsers) || ctx.users.HasRole(ctx.userID, cmd.allowRoles)
+	}
+
+	return true
+}
+
 // /shell2telegram stat
 func cmdShell2telegramStat(ctx Ctx) (replayMsg string) {
 	for userID := range ctx.users.list {
@@ -152,6 +478,24 @@ func cmdShell2telegramStat(ctx Ctx) (replayMsg string) {
 	return replayMsg
 }
 
+// /shell2telegram ps - list of running commands of all users
+func cmdShell2telegramPs(ctx Ctx) (replayMsg string) {
+	jobs := ctx.jobs.List(0)
+	if len(jobs) == 0 {
+		return "No running commands"
+	}
+
+	jobsMsg := []string{}
+	for _, job := range jobs {
+		owner := "scheduler"
+		if job.userID != 0 {
+			owner = ctx.users.String(job.userID)
+		}
+		jobsMsg = append(jobsMsg, owner+": "+job.String())
+	}
+	return strings.Join(jobsMsg, "\n")
+}
+
 // /shell2telegram search
 func cmdShell2telegramSearch(ctx Ctx) (replayMsg string) {
 	query := ctx.messageArgs
@@ -186,6 +530,71 @@ func cmdShell2telegramBan(ctx Ctx) (replayMsg string) {
 	return replayMsg
 }
 
+// /shell2telegram auth user_id|username [root] - authorize user without secret code
+func cmdShell2telegramAuth(ctx Ctx) (replayMsg string) {
+	userName, role := splitStringHalfBySpace(ctx.messageArgs)
+
+	if userName == "" || role != "" && role != "root" {
+		return "Please set user: /shell2telegram auth <user_id|username> [root]"
+	}
+
+	userID := ctx.users.FindByIDOrUserName(userName)
+
+	if userID > 0 {
+		ctx.users.SetAuthorized(userID, role == "root")
+		replayMsg = fmt.Sprintf("User %s authorized", ctx.users.String(userID))
+		if role == "root" {
+			replayMsg += " as root"
+		}
+		log.Print(replayMsg)
+	} else {
+		replayMsg = "User not found"
+	}
+
+	return replayMsg
+}
+
+// /shell2telegram role user_id|username role - assign role to user
+func cmdShell2telegramRole(ctx Ctx) (replayMsg string) {
+	userName, role := splitStringHalfBySpace(ctx.messageArgs)
+
+	if userName == "" || role == "" {
+		return "Please set user and role: /shell2telegram role <user_id|username> <role>"
+	}
+	if !stringInList(role, ctx.appConfig.roles) {
+		return fmt.Sprintf("Role %s not found, available roles: %s", role, strings.Join(ctx.appConfig.roles, ", "))
+	}
+
+	userID := ctx.users.FindByIDOrUserName(userName)
+
+	if userID > 0 && ctx.users.AddRole(userID, role) {
+		replayMsg = fmt.Sprintf("Role %s assigned to user %s", role, ctx.users.String(userID))
+	} else {
+		replayMsg = "User not found"
+	}
+
+	return replayMsg
+}
+
+// /shell2telegram unrole user_id|username role - remove role from user
+func cmdShell2telegramUnrole(ctx Ctx) (replayMsg string) {
+	userName, role := splitStringHalfBySpace(ctx.messageArgs)
+
+	if userName == "" || role == "" {
+		return "Please set user and role: /shell2telegram unrole <user_id|username> <role>"
+	}
+
+	userID := ctx.users.FindByIDOrUserName(userName)
+
+	if userID > 0 && ctx.users.RemoveRole(userID, role) {
+		replayMsg = fmt.Sprintf("Role %s removed from user %s", role, ctx.users.String(userID))
+	} else {
+		replayMsg = "User or role not found"
+	}
+
+	return replayMsg
+}
+
 // set bot description
 func cmdShell2telegramDesc(ctx Ctx) (replayMsg string) {
 	description := ctx.messageArgs
@@ -217,6 +626,33 @@ func cmdShell2telegramRm(ctx Ctx) (replayMsg string) {
 	return replayMsg
 }
 
+// add "/command" "shell command" - add command until reload of config, only for shell2telegram ctl
+func cmdShell2telegramAdd(ctx Ctx) (replayMsg string) {
+	pathRaw, shellCmd := splitStringHalfBySpace(ctx.messageArgs)
+
+	if pathRaw == "" || shellCmd == "" {
+		return "Please set command and shell command: add </command[:modificators]> <shell command>"
+	}
+
+	path, command, err := parseBotCommand(pathRaw, shellCmd)
+	if err == nil {
+		err = checkCommands(Commands{path: command}, ctx.appConfig.roles)
+	}
+	if err != nil {
+		return err.Error()
+	}
+
+	// commands from config file and command line are restored by reload, so added commands are runtime-only
+	if _, ok := ctx.commands[path]; ok {
+		replayMsg = "Replaced command: " + path + " (until reload of config)"
+	} else {
+		replayMsg = "Added command: " + path + " (until reload of config)"
+	}
+	ctx.commands[path] = command
+
+	return replayMsg
+}
+
 // /shell2telegram version - get version
 func cmdShell2telegramVersion(_ Ctx) (replayMsg string) {
 	replayMsg = fmt.Sprintf("shell2telegram %s", version)
@@ -234,6 +670,14 @@ func cmdShell2telegramExit(ctx Ctx) (replayMsg string) {
 	return replayMsg
 }
 
+// /shell2telegram reload - reload commands and settings from config file and command-line
+func cmdShell2telegramReload(ctx Ctx) (replayMsg string) {
+	go func() {
+		ctx.reloadSignal <- struct{}{}
+	}()
+	return "Reloading..."
+}
+
 // /shell2telegram broadcast_to_root - broadcast message to root users in private chat
 func cmdShell2telegramBroadcastToRoot(ctx Ctx) (replayMsg string) {
 	message := ctx.messageArgs
@@ -241,8 +685,12 @@ func cmdShell2telegramBroadcastToRoot(ctx Ctx) (replayMsg string) {
 	if message == "" {
 		replayMsg = "Please set message: /shell2telegram broadcast_to_root <message>"
 	} else {
+		sender := "console"
+		if ctx.userID != 0 {
+			sender = ctx.users.String(ctx.userID)
+		}
 		ctx.users.BroadcastForRoots(ctx.messageSignal,
-			fmt.Sprintf("Message from %s:\n%s", ctx.users.String(ctx.userID), message),
+			fmt.Sprintf("Message from %s:\n%s", sender, message),
 			ctx.userID, // don't send self
 		)
 		replayMsg = "Message sent"
@@ -270,3 +718,18 @@ func cmdShell2telegramMessageToUser(ctx Ctx) (replayMsg string) {
 
 	return replayMsg
 }
+
+// /shell2telegram send chat_id|user_id|username "message" - send message to chat or user in private chat
+func cmdShell2telegramSend(ctx Ctx) (replayMsg string) {
+	to, message := splitStringHalfBySpace(ctx.messageArgs)
+
+	if to == "" || message == "" {
+		return "Please set chat and message: /shell2telegram send <chat_id|user_id|username> <message>"
+	}
+
+	if err := apiSend(*ctx.users, ctx.messageSignal, apiRequest{To: to, Text: message}); err != nil {
+		return err.Error()
+	}
+
+	return "Message sent"
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msoap/raphanus"
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+func Test_isAllowedCommand(t *testing.T) {
+	users := Users{list: map[int]*User{
+		1: {UserID: 1, UserName: "root_user", IsAuthorized: true, IsRoot: true},
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+		3: {UserID: 3, IsAuthorized: true},
+		4: {UserID: 4, UserName: "ops_user", IsAuthorized: true, Roles: []string{"ops", "viewer"}},
+	}}
+
+	data := []struct {
+		cmd     Command
+		userID  int
+		chatID  int
+		allowed bool
+	}{
+		{Command{}, 2, 100, true},
+		{Command{rootOnly: true}, 2, 100, false},
+		{Command{rootOnly: true}, 1, 100, true},
+		{Command{allowUsers: []string{"user2"}}, 2, 100, true},
+		{Command{allowUsers: []string{"user2"}}, 3, 100, false},
+		{Command{allowUsers: []string{"3"}}, 3, 100, true},
+		{Command{allowUsers: []string{"user2"}}, 1, 100, true},
+		{Command{allowChats: []int{100, 200}}, 2, 200, true},
+		{Command{allowChats: []int{100, 200}}, 2, 300, false},
+		{Command{allowChats: []int{100}}, 1, 300, false},
+		{Command{allowUsers: []string{"user2"}, allowChats: []int{100}}, 2, 100, true},
+		{Command{allowRoles: []string{"ops"}}, 4, 100, true},
+		{Command{allowRoles: []string{"deploy"}}, 4, 100, false},
+		{Command{allowRoles: []string{"ops"}}, 2, 100, false},
+		{Command{allowRoles: []string{"deploy"}, allowUsers: []string{"user2"}}, 2, 100, true},
+	}
+
+	for i, item := range data {
+		ctx := Ctx{users: &users, userID: item.userID, chatID: item.chatID}
+		if allowed := isAllowedCommand(ctx, item.cmd); allowed != item.allowed {
+			t.Errorf("%d. isAllowedCommand() failed for %#v, user: %d, chat: %d", i+1, item.cmd, item.userID, item.chatID)
+		}
+	}
+}
+
+func Test_cmdShell2telegramRole(t *testing.T) {
+	users := Users{list: map[int]*User{
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+	}}
+	ctx := Ctx{users: &users, appConfig: &Config{roles: []string{"ops", "viewer"}}}
+
+	ctx.messageArgs = "@user2 ops"
+	cmdShell2telegramRole(ctx)
+	ctx.messageArgs = "2 viewer"
+	cmdShell2telegramRole(ctx)
+	ctx.messageArgs = "user2 unknown"
+	cmdShell2telegramRole(ctx)
+	if !reflect.DeepEqual(users.list[2].Roles, []string{"ops", "viewer"}) {
+		t.Errorf("1. cmdShell2telegramRole() failed: %#v", users.list[2].Roles)
+	}
+
+	ctx.messageArgs = "user2 ops"
+	cmdShell2telegramUnrole(ctx)
+	if !reflect.DeepEqual(users.list[2].Roles, []string{"viewer"}) {
+		t.Errorf("2. cmdShell2telegramUnrole() failed: %#v", users.list[2].Roles)
+	}
+	if !strings.Contains(users.StringVerbose(2), "roles: viewer") {
+		t.Errorf("3. StringVerbose() failed: %s", users.StringVerbose(2))
+	}
+}
+
+func Test_cmdShell2telegramCtl(t *testing.T) {
+	users := Users{list: map[int]*User{
+		2: {UserID: 2, UserName: "user2", PrivateChatID: 22},
+	}}
+	commands := Commands{"/date": {shellCmd: "date"}}
+	messageSignal := make(chan BotMessage, 10)
+	ctx := Ctx{users: &users, commands: commands, messageSignal: messageSignal, appConfig: &Config{roles: []string{"ops"}}}
+
+	data := []struct {
+		handler      func(Ctx) string
+		args, result string
+	}{
+		{cmdShell2telegramAuth, "@user2", "User   (@user2) authorized"},
+		{cmdShell2telegramAuth, "2 root", "User   (@user2) authorized as root"},
+		{cmdShell2telegramAuth, "@unknown", "User not found"},
+		{cmdShell2telegramAuth, "2 admin", "Please set user: /shell2telegram auth <user_id|username> [root]"},
+		{cmdShell2telegramAdd, "/uptime:desc=Uptime uptime -p", "Added command: /uptime (until reload of config)"},
+		{cmdShell2telegramAdd, "/date date -u", "Replaced command: /date (until reload of config)"},
+		{cmdShell2telegramAdd, "/ps:roles=admin ps aux", "error: role admin of command /ps is not defined in -roles"},
+		{cmdShell2telegramAdd, "date date", "error: path date don't starts with /"},
+		{cmdShell2telegramAdd, "/date", "Please set command and shell command: add </command[:modificators]> <shell command>"},
+		{cmdShell2telegramSend, "-100123 hello", "Message sent"},
+		{cmdShell2telegramSend, "@user2 hello", "Message sent"},
+		{cmdShell2telegramSend, "@unknown hello", "user @unknown not found"},
+		{cmdShell2telegramBroadcastToRoot, "hello roots", "Message sent"},
+	}
+
+	for _, item := range data {
+		ctx.messageArgs = item.args
+		if result := item.handler(ctx); result != item.result {
+			t.Errorf("Failing for %q\nexpected: %q, real: %q", item.args, item.result, result)
+		}
+	}
+
+	if !users.list[2].IsAuthorized || !users.list[2].IsRoot {
+		t.Errorf("cmdShell2telegramAuth failed: %#v", users.list[2])
+	}
+	if commands["/uptime"].shellCmd != "uptime -p" || commands["/uptime"].description != "Uptime" || commands["/date"].shellCmd != "date -u" {
+		t.Errorf("cmdShell2telegramAdd failed: %#v", commands)
+	}
+	chatIDs := []int{}
+	for i := 0; i < 3; i++ {
+		chatIDs = append(chatIDs, (<-messageSignal).chatID)
+	}
+	sort.Ints(chatIDs)
+	if !reflect.DeepEqual(chatIDs, []int{-100123, 22, 22}) {
+		t.Errorf("messages sent to wrong chats: %v", chatIDs)
+	}
+}
+
+func Test_cmdCallbackQueryConfirm(t *testing.T) {
+	users := Users{list: map[int]*User{
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+		3: {UserID: 3, UserName: "user3", IsAuthorized: true},
+	}}
+	callbacks := NewCallbacks()
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+	_, command, _ := parseBotCommand("/restart:confirm", "echo restarted")
+
+	ctx := Ctx{
+		appConfig:      &Config{shell: "sh", confirmTimeout: DefaultConfirmTimeout},
+		users:          &users,
+		commands:       Commands{"/restart": command},
+		userID:         2,
+		chatID:         100,
+		allowExec:      true,
+		messageCmd:     "/restart",
+		messageArgs:    "app",
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+		callbacks:      callbacks,
+	}
+
+	cmdUser(ctx)
+	confirmMessage := <-messageSignal
+	markup, ok := confirmMessage.replyMarkup.(InlineKeyboardMarkup)
+	if confirmMessage.message != "Run /restart app?" || !ok || len(markup.InlineKeyboard[0]) != 2 {
+		t.Fatalf("1. confirm message failed: %#v", confirmMessage)
+	}
+	runData := markup.InlineKeyboard[0][0].CallbackData
+
+	// other user
+	otherCtx := ctx
+	otherCtx.userID = 3
+	cmdCallbackQuery(otherCtx, &CallbackQuery{ID: "q1", Data: runData, Message: &tgbotapi.Message{MessageID: 10}})
+	if answer := <-messageSignal; answer.messageType != msgIsCallbackAnswer || answer.message != "This button is not for you" {
+		t.Errorf("2. answer for other user failed: %#v", answer)
+	}
+
+	cmdCallbackQuery(ctx, &CallbackQuery{ID: "q2", Data: runData, Message: &tgbotapi.Message{MessageID: 10}})
+	received := map[int8]string{}
+	for i := 0; i < 3; i++ {
+		message := <-messageSignal
+		received[message.messageType] += message.message
+	}
+	if received[msgIsEdit] != "Confirmed: /restart app" || received[msgIsText] != "restarted\n" {
+		t.Errorf("3. run after confirm failed: %#v", received)
+	}
+
+	// button pressed twice
+	cmdCallbackQuery(ctx, &CallbackQuery{ID: "q3", Data: runData, Message: &tgbotapi.Message{MessageID: 10}})
+	if answer := <-messageSignal; answer.message != "Confirmation expired" {
+		t.Errorf("4. second press failed: %#v", answer)
+	}
+	<-messageSignal
+}
+
+func Test_cmdCallbackButton(t *testing.T) {
+	users := Users{list: map[int]*User{
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+	}}
+	callbacks := NewCallbacks()
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+
+	ctx := Ctx{
+		appConfig: &Config{shell: "sh", buttonTimeout: DefaultButtonTimeout},
+		users:     &users,
+		commands: Commands{
+			"/restart": {shellCmd: "echo restarted $SERVICE", vars: []string{"SERVICE"}},
+			"/reboot":  {shellCmd: "echo reboot", rootOnly: true},
+		},
+		userID:         2,
+		chatID:         100,
+		allowExec:      true,
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+		callbacks:      callbacks,
+	}
+
+	restartID := callbacks.Add(callbackAction{chatID: 100, command: "/restart", args: "nginx"}, DefaultButtonTimeout)
+	rebootID := callbacks.Add(callbackAction{chatID: 100, command: "/reboot"}, DefaultButtonTimeout)
+	removedID := callbacks.Add(callbackAction{chatID: 100, command: "/removed"}, DefaultButtonTimeout)
+	expiredID := callbacks.Add(callbackAction{chatID: 100, command: "/restart"}, -1)
+
+	otherChatCtx := ctx
+	otherChatCtx.chatID = 200
+	notAuthorizedCtx := ctx
+	notAuthorizedCtx.allowExec = false
+
+	data := []struct {
+		ctx    Ctx
+		data   string
+		answer string
+		output string
+	}{
+		{ctx, restartID + ":cmd", "Running /restart nginx", "restarted nginx\n"},
+		// button may be pressed many times
+		{ctx, restartID + ":cmd", "Running /restart nginx", "restarted nginx\n"},
+		{otherChatCtx, restartID + ":cmd", "This button is not for you", ""},
+		{notAuthorizedCtx, restartID + ":cmd", "Access denied", ""},
+		{ctx, rebootID + ":cmd", "Access denied", ""},
+		{ctx, removedID + ":cmd", "Command not found", ""},
+		{ctx, expiredID + ":cmd", "Button expired", ""},
+		{ctx, "forged:cmd", "Button expired", ""},
+	}
+
+	for i, item := range data {
+		cmdCallbackQuery(item.ctx, &CallbackQuery{ID: "q", Data: item.data, Message: &tgbotapi.Message{MessageID: 10}})
+		received := map[int8]string{}
+		count := 1
+		if item.output != "" {
+			count = 2
+		}
+		for j := 0; j < count; j++ {
+			message := <-messageSignal
+			received[message.messageType] += message.message
+		}
+		if received[msgIsCallbackAnswer] != item.answer || received[msgIsText] != item.output {
+			t.Errorf("%d. Failing for %q\nexpected: %q/%q, real: %#v", i, item.data, item.answer, item.output, received)
+		}
+	}
+}
+
+func Test_parseUserMessage(t *testing.T) {
+	commands := Commands{
+		"/logs":  {shellCmd: "grep ERROR $S2T_FILE_PATH", acceptFile: true},
+		"/date":  {shellCmd: "date"},
+		cmdImage: {shellCmd: "cat"},
+	}
+
+	data := []struct {
+		message     tgbotapi.Message
+		messageCmd  string
+		messageArgs string
+		fileName    string
+		messageEnv  []string
+	}{
+		{
+			message:    tgbotapi.Message{Text: "/date -u"},
+			messageCmd: "/date", messageArgs: "-u",
+		}, {
+			message:    tgbotapi.Message{Text: "plain text"},
+			messageCmd: cmdPlainText, messageArgs: "plain text",
+		}, {
+			message:    tgbotapi.Message{Text: "/:image args"},
+			messageCmd: "", messageArgs: "args",
+		}, {
+			message:    tgbotapi.Message{Photo: []tgbotapi.PhotoSize{{FileID: "small"}, {FileID: "big"}}, Caption: "caption"},
+			messageCmd: cmdImage, messageArgs: "caption", fileName: "image.jpg",
+		}, {
+			message:    tgbotapi.Message{Document: tgbotapi.Document{FileID: "doc", FileName: "app.log"}, Caption: "/logs today"},
+			messageCmd: "/logs", messageArgs: "today", fileName: "app.log",
+		}, {
+			message:    tgbotapi.Message{Document: tgbotapi.Document{FileID: "doc", FileName: "app.log"}, Caption: "/date now"},
+			messageCmd: cmdDocument, messageArgs: "/date now", fileName: "app.log",
+		}, {
+			message:    tgbotapi.Message{Voice: tgbotapi.Voice{FileID: "voice", Duration: 3}},
+			messageCmd: cmdVoice, fileName: "voice.ogg", messageEnv: []string{"S2T_DURATION=3"},
+		}, {
+			message:    tgbotapi.Message{Location: tgbotapi.Location{Latitude: 50.45, Longitude: 30.52}},
+			messageCmd: cmdLocation, messageEnv: []string{"S2T_LATITUDE=50.45", "S2T_LONGITUDE=30.52"},
+		}, {
+			message:    tgbotapi.Message{Contact: tgbotapi.Contact{PhoneNumber: "+123", FirstName: "Name", UserID: 42}},
+			messageCmd: cmdContact,
+			messageEnv: []string{"S2T_PHONE=+123", "S2T_CONTACT_FIRST_NAME=Name", "S2T_CONTACT_LAST_NAME=", "S2T_CONTACT_USERID=42"},
+		},
+	}
+
+	for i, item := range data {
+		messageCmd, messageArgs, file, messageEnv := parseUserMessage(item.message, commands)
+		fileName := ""
+		if file != nil {
+			fileName = file.fileName
+		}
+		if messageCmd != item.messageCmd || messageArgs != item.messageArgs || fileName != item.fileName || !reflect.DeepEqual(messageEnv, item.messageEnv) {
+			t.Errorf("%d. parseUserMessage() failed: %q, %q, %q, %#v", i+1, messageCmd, messageArgs, fileName, messageEnv)
+		}
+	}
+}
+
+func Test_cmdUserResult(t *testing.T) {
+	data := []struct {
+		pathRaw, shellCmd string
+		result            string // regexp, duration of command may be different on slow machine
+	}{
+		{"/cmd", "echo ok", `^ok\n$`},
+		{"/cmd", "echo out; echo err >&2; exit 2", `^out\n\nexit code 2, \d+s$`},
+		{"/cmd:stderr", "echo out; echo err >&2; exit 2", `^out\nerr\n\nexit code 2, \d+s$`},
+		{"/cmd:status", "echo ok", `^ok\n\nexit code 0, \d+s$`},
+		{"/cmd:timeout=1", "echo start; sleep 5", `^start\n\ntimeout, killed after \d+s$`},
+		{"/cmd:on_error=only", "echo ok", ""},
+		{"/cmd:on_error=only", "exit 1", `^exit code 1, \d+s$`},
+	}
+
+	for _, item := range data {
+		messageSignal := make(chan BotMessage, MessagesQueueSize)
+		cache := raphanus.New()
+		_, command, err := parseBotCommand(item.pathRaw, item.shellCmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := Ctx{
+			appConfig:      &Config{shell: "sh"},
+			users:          &Users{list: map[int]*User{1: {UserID: 1, UserName: "user1", IsAuthorized: true}}},
+			commands:       Commands{"/cmd": command},
+			userID:         1,
+			chatID:         100,
+			allowExec:      true,
+			messageCmd:     "/cmd",
+			messageSignal:  messageSignal,
+			cache:          &cache,
+			oneThreadMutex: &sync.Mutex{},
+			jobs:           NewJobs(),
+		}
+		cmdUser(ctx)
+
+		wait := 3 * time.Second
+		if item.result == "" {
+			wait = 300 * time.Millisecond
+		}
+		result := ""
+		select {
+		case message := <-messageSignal:
+			result = message.message
+		case <-time.After(wait):
+		}
+		if item.result == "" && result != "" || item.result != "" && !regexp.MustCompile(item.result).MatchString(result) {
+			t.Errorf("Failing for %s %q\nexpected: %q, real: %q", item.pathRaw, item.shellCmd, item.result, result)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config file (YAML or JSON) with options and commands, for example:
+//
+//	options:                  # same as command-line options
+//	  sh-timeout: 10
+//	  allow-users: [user1, user2]
+//	commands:
+//	  /date: date             # short form: /command: shell command
+//	  /alarm:                 # full form with modificators
+//	    shell: sleep $SLEEP; echo $MSG
+//	    desc: Alarm
+//	    vars: [SLEEP, MSG]
+//	    md: true
+//	    env: {LANG: C}
+//	schedules:
+//	  disk:                   # name of schedule
+//	    cron: '0 9 * * 1-5'   # cron expression or @hourly, @daily, ...
+//	    to: [-100123, user1]  # chat IDs or users
+//	    shell: df -h          # shell command and modificators as in commands
+//	    format: pre
+
+// loadConfigFile - load options, commands and schedules from config file,
+// options which were set from command-line are not overridden
+func loadConfigFile(fileName string, flagSet *flag.FlagSet) (commands Commands, schedules []Schedule, err error) {
+	commands = Commands{}
+
+	configData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return commands, nil, fmt.Errorf("read config file failed: %s", err)
+	}
+
+	root := yaml.Node{}
+	if err = yaml.Unmarshal(configData, &root); err != nil {
+		return commands, nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if len(root.Content) == 0 {
+		// empty file
+		return commands, nil, nil
+	}
+
+	document := root.Content[0]
+	if document.Kind != yaml.MappingNode {
+		return commands, nil, fmt.Errorf("%s: %s", fileName, nodeError(document, "config must be a mapping with options and commands"))
+	}
+
+	var schedulesNode *yaml.Node
+	for i := 0; i < len(document.Content); i += 2 {
+		key, value := document.Content[i], document.Content[i+1]
+		switch key.Value {
+		case "options":
+			err = parseConfigOptions(value, flagSet)
+		case "commands":
+			commands, err = parseConfigCommands(value)
+		case "schedules":
+			// parsed after options, commands of schedules are checked with -roles
+			schedulesNode = value
+		default:
+			err = nodeError(key, "unknown section %q", key.Value)
+		}
+		if err != nil {
+			return commands, schedules, fmt.Errorf("%s: %s", fileName, err)
+		}
+	}
+
+	if schedulesNode != nil {
+		roles := []string{}
+		if rolesStr := flagSet.Lookup("roles").Value.String(); rolesStr != "" {
+			roles = strings.Split(rolesStr, ",")
+		}
+		if schedules, err = parseConfigSchedules(schedulesNode, roles); err != nil {
+			return commands, schedules, fmt.Errorf("%s: %s", fileName, err)
+		}
+	}
+
+	return commands, schedules, nil
+}
+
+// parseConfigOptions - set options from config file via command-line flags
+func parseConfigOptions(node *yaml.Node, flagSet *flag.FlagSet) error {
+	if node.Kind != yaml.MappingNode {
+		return nodeError(node, "options must be a mapping")
+	}
+
+	setFromCommandLine := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		setFromCommandLine[f.Name] = true
+	})
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value == "config" || flagSet.Lookup(key.Value) == nil {
+			return nodeError(key, "unknown option %q", key.Value)
+		}
+
+		valueStr, err := nodeString(value)
+		if err != nil {
+			return err
+		}
+		if setFromCommandLine[key.Value] {
+			continue
+		}
+		if err := flagSet.Set(key.Value, valueStr); err != nil {
+			return nodeError(value, "invalid value for option %q: %s", key.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// parseConfigCommands - parse commands from config file
+func parseConfigCommands(node *yaml.Node) (commands Commands, err error) {
+	commands = Commands{}
+	if node.Kind != yaml.MappingNode {
+		return commands, nodeError(node, "commands must be a mapping of /command: shell command")
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		shellCmd, attrs := "", []string{}
+		switch value.Kind {
+		case yaml.ScalarNode:
+			shellCmd = value.Value
+		case yaml.MappingNode:
+			if shellCmd, attrs, err = parseConfigCommandAttrs(value); err != nil {
+				return commands, err
+			}
+		default:
+			return commands, nodeError(value, "command %s must be a shell command or a mapping", key.Value)
+		}
+
+		path, command, err := parseBotCommand(key.Value, shellCmd)
+		if err != nil {
+			return commands, nodeError(key, "%s", err)
+		}
+		for _, attr := range attrs {
+			if err = parseCommandAttr(&command, attr); err != nil {
+				return commands, nodeError(key, "%s", err)
+			}
+		}
+		if _, exists := commands[path]; exists {
+			return commands, nodeError(key, "command %s already defined", path)
+		}
+		commands[path] = command
+	}
+
+	return commands, nil
+}
+
+// parseConfigSchedules - parse schedules from config file, commands are checked as bot commands
+func parseConfigSchedules(node *yaml.Node, roles []string) (schedules []Schedule, err error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nodeError(node, "schedules must be a mapping of name: schedule")
+	}
+
+	names := map[string]bool{}
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.MappingNode {
+			return nil, nodeError(value, "schedule %s must be a mapping with cron, to and shell", key.Value)
+		}
+
+		// cron and targets, other fields are shell command with modificators
+		cronExpr, targets := "", []string{}
+		commandNode := &yaml.Node{Kind: yaml.MappingNode, Line: value.Line}
+		for j := 0; j < len(value.Content); j += 2 {
+			itemKey, itemValue := value.Content[j], value.Content[j+1]
+			switch itemKey.Value {
+			case "cron":
+				cronExpr = itemValue.Value
+			case "to":
+				targetsStr, err := nodeString(itemValue)
+				if err != nil {
+					return nil, err
+				}
+				targets = strings.Split(targetsStr, ",")
+			default:
+				commandNode.Content = append(commandNode.Content, itemKey, itemValue)
+			}
+		}
+
+		shellCmd, attrs, err := parseConfigCommandAttrs(commandNode)
+		if err != nil {
+			return nil, err
+		}
+		command := Command{shellCmd: shellCmd}
+		for _, attr := range attrs {
+			if err = parseCommandAttr(&command, attr); err != nil {
+				return nil, nodeError(key, "%s", err)
+			}
+		}
+		if err = checkScheduleCommand(key.Value, command, roles); err != nil {
+			return nil, nodeError(key, "%s", err)
+		}
+
+		schedule, err := newSchedule(key.Value, cronExpr, targets, command)
+		if err != nil {
+			return nil, nodeError(key, "%s", err)
+		}
+		if names[schedule.Name] {
+			return nil, nodeError(key, "schedule %s already defined", schedule.Name)
+		}
+		names[schedule.Name] = true
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+// parseConfigCommandAttrs - get shell command and modificators (in "name=value" form) from command mapping
+func parseConfigCommandAttrs(node *yaml.Node) (shellCmd string, attrs []string, err error) {
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		if value.Kind == yaml.MappingNode {
+			// modificators with names, like env: {FOO: bar}
+			for j := 0; j < len(value.Content); j += 2 {
+				itemValue, err := nodeString(value.Content[j+1])
+				if err != nil {
+					return "", nil, err
+				}
+				attrs = append(attrs, key.Value+"="+value.Content[j].Value+"="+itemValue)
+			}
+			continue
+		}
+
+		valueStr, err := nodeString(value)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch {
+		case key.Value == "shell":
+			shellCmd = valueStr
+		case key.Value == "interpreter":
+			// "shell" is the shell command, so :shell modificator is set by other name
+			attrs = append(attrs, "shell="+valueStr)
+		case value.ShortTag() == "!!bool":
+			// flag modificators, like md: true
+			if valueStr == "true" {
+				attrs = append(attrs, key.Value)
+			}
+		default:
+			attrs = append(attrs, key.Value+"="+valueStr)
+		}
+	}
+
+	if shellCmd == "" {
+		return "", nil, nodeError(node, "shell command cannot be empty")
+	}
+
+	return shellCmd, attrs, nil
+}
+
+// nodeString - get value of scalar or list of scalars (joined by ",")
+func nodeString(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		values := []string{}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", nodeError(item, "list items must be scalars")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", nodeError(node, "value must be a scalar or a list")
+	}
+}
+
+// nodeError - create error with line number of config file
+func nodeError(node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", node.Line, fmt.Sprintf(format, args...))
+}
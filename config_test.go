@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "shell2telegram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return fileName
+}
+
+func Test_loadConfigFile(t *testing.T) {
+	data := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "config.yml",
+			content: `
+options:
+  sh-timeout: 10
+  allow-users: [user1, user2]
+  description: from file
+commands:
+  /date: date
+  /alarm:
+    shell: sleep $SLEEP; echo $MSG
+    desc: Alarm
+    vars: [SLEEP, MSG]
+    md: true
+    interpreter: bash
+`,
+		}, {
+			name: "config.json",
+			content: `{
+  "options": {"sh-timeout": 10, "allow-users": ["user1", "user2"], "description": "from file"},
+  "commands": {
+    "/date": "date",
+    "/alarm": {"shell": "sleep $SLEEP; echo $MSG", "desc": "Alarm", "vars": ["SLEEP", "MSG"], "md": true, "interpreter": "bash"}
+  }
+}`,
+		},
+	}
+
+	for _, item := range data {
+		appConfig := Config{}
+		flagSet := newFlagSet(&appConfig, 0)
+		if err := flagSet.Parse([]string{"-description=from command-line"}); err != nil {
+			t.Fatal(err)
+		}
+
+		commands, _, err := loadConfigFile(writeTestConfig(t, item.name, item.content), flagSet)
+		if err != nil {
+			t.Errorf("%s: %s", item.name, err)
+			continue
+		}
+
+		if appConfig.shTimeout != 10 || !reflect.DeepEqual(appConfig.predefinedAllowedUsers, []string{"user1", "user2"}) {
+			t.Errorf("%s: options not applied: %+v", item.name, appConfig)
+		}
+		if appConfig.description != "from command-line" {
+			t.Errorf("%s: option from command-line overridden by file: %s", item.name, appConfig.description)
+		}
+
+		expected := Commands{
+			"/date": {shellCmd: "date"},
+			"/alarm": {
+				shellCmd:    "sleep $SLEEP; echo $MSG",
+				description: "Alarm",
+				vars:        []string{"SLEEP", "MSG"},
+				isMarkdown:  true,
+				shell:       "bash",
+			},
+		}
+		if !reflect.DeepEqual(commands, expected) {
+			t.Errorf("%s: commands\nexpected: %#v\nreal: %#v", item.name, expected, commands)
+		}
+	}
+}
+
+func Test_loadConfigFileRegexpWithColon(t *testing.T) {
+	content := `
+commands:
+  /alarm:
+    shell: echo $TIME
+    vars: [TIME]
+    re: {TIME: '^\d\d:\d\d$'}
+`
+	commands, _, err := loadConfigFile(writeTestConfig(t, "config.yml", content), newFlagSet(&Config{}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := commands["/alarm"]
+	if command.argChecks["TIME"].re != `^\d\d:\d\d$` {
+		t.Errorf("regexp with colon failed: %#v", command.argChecks)
+	}
+	if usageMsg := checkArgs("/alarm", command, "12:30"); usageMsg != "" {
+		t.Errorf("valid argument failed: %q", usageMsg)
+	}
+	if usageMsg := checkArgs("/alarm", command, "1230"); usageMsg != "Usage: /alarm TIME\nTIME: must match ^\\d\\d:\\d\\d$" {
+		t.Errorf("invalid argument failed: %q", usageMsg)
+	}
+}
+
+func Test_loadConfigFileSchedules(t *testing.T) {
+	content := `
+commands:
+  /date: date
+schedules:
+  disk:
+    cron: 0 9 * * 1-5
+    to: [-100123, user1]
+    shell: df -h
+    format: pre
+  backup:
+    cron: '@daily'
+    to: root_user
+    shell: make backup
+    on_error: roots
+`
+	appConfig := Config{}
+	_, schedules, err := loadConfigFile(writeTestConfig(t, "config.yml", content), newFlagSet(&appConfig, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schedules) != 2 ||
+		schedules[0].Name != "disk" || schedules[0].Cron != "0 9 * * 1-5" || schedules[0].command.format != "pre" ||
+		!reflect.DeepEqual(schedules[0].Targets, []string{"-100123", "user1"}) ||
+		schedules[1].Name != "backup" || schedules[1].command.onError != "roots" || schedules[1].ShellCmd != "make backup" {
+		t.Errorf("schedules failed: %+v", schedules)
+	}
+}
+
+func Test_loadConfigFileErrors(t *testing.T) {
+	data := []struct {
+		content string
+		err     string
+	}{
+		{"- a\n- b\n", "line 1: config must be a mapping"},
+		{"options:\n  sh-timeout: 1\n  unknown: 1\n", `line 3: unknown option "unknown"`},
+		{"options:\n  sh-timeout: abc\n", `line 2: invalid value for option "sh-timeout"`},
+		{"commands:\n  /date: date\n  /cmd:\n    desc: Name\n", "line 4: shell command cannot be empty"},
+		{"commands:\n  /date: date\n  /cmd:\n    shell: ls\n    unknown: 1\n", "line 3: error: parse command modificators, not found unknown"},
+		{"commands:\n  date: date\n", "line 2: error: path date don't starts with /"},
+		{"commands:\n  /date: date\n  /date:md: date\n", "line 3: command /date already defined"},
+		{"other: 1\n", `line 1: unknown section "other"`},
+		{"schedules:\n  disk:\n    cron: 0 9 * * *\n    shell: df\n", "line 2: error: schedule disk must have chats or users"},
+		{"schedules:\n  disk:\n    cron: 0 25 * * *\n    to: [1]\n    shell: df\n", "line 2: error: cron expression"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df\n    unknown: 1\n", "line 2: error: parse command modificators"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df\n    roles: ops\n", "line 2: error: role ops of command schedule disk is not defined in -roles"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df $DIR\n    vars: [DIR]\n    int: {N: [1, 10]}\n", "line 2: error: argument N for validation is not defined in vars (command schedule disk)"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df\n    output: json\n    as_document: true\n", "line 2: error: :output=json cannot be used with :stream or :as_document (command schedule disk)"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df\n    stream: true\n", "line 2: error: :stream, :confirm and :accept_file cannot be used in schedule disk"},
+		{"schedules:\n  disk:\n    cron: '@daily'\n    to: [1]\n    shell: df\n    confirm: true\n", "line 2: error: :stream, :confirm and :accept_file cannot be used in schedule disk"},
+	}
+
+	for _, item := range data {
+		appConfig := Config{}
+		_, _, err := loadConfigFile(writeTestConfig(t, "config.yml", item.content), newFlagSet(&appConfig, 0))
+		if err == nil || !strings.Contains(err.Error(), item.err) {
+			t.Errorf("Failing for %q\nexpected: %s\nreal: %v", item.content, item.err, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec - parsed cron expression, every field is a bitset of allowed values
+type cronSpec struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	anyDayOfMonth, anyDayOfWeek                bool
+}
+
+// cronAliases - predefined cron expressions
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// parseCron - parse cron expression: "minute hour day-of-month month day-of-week" or @hourly, @daily, @weekly, @monthly, @yearly,
+// fields may be: *, 5, 1-5, */15, 1-30/5, 1,15,30
+func parseCron(expr string) (spec cronSpec, err error) {
+	if alias, ok := cronAliases[expr]; ok {
+		expr = alias
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return spec, fmt.Errorf("error: cron expression must have 5 fields: %q", expr)
+	}
+
+	bounds := [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	values := [5]*uint64{&spec.minute, &spec.hour, &spec.dayOfMonth, &spec.month, &spec.dayOfWeek}
+	for i, field := range fields {
+		if *values[i], err = parseCronField(field, bounds[i].min, bounds[i].max); err != nil {
+			return spec, fmt.Errorf("error: cron expression %q: %s", expr, err)
+		}
+	}
+
+	// 7 is Sunday too
+	if spec.dayOfWeek&(1<<7) != 0 {
+		spec.dayOfWeek |= 1
+	}
+	spec.anyDayOfMonth, spec.anyDayOfWeek = fields[2] == "*", fields[4] == "*"
+
+	return spec, nil
+}
+
+// parseCronField - parse one field of cron expression to bitset
+func parseCronField(field string, min, max int) (result uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart := splitStringHalfBy(part, "/")
+		step := 1
+		if strings.Contains(part, "/") {
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+		}
+
+		from, to := min, max
+		if rangePart != "*" {
+			fromPart, toPart := splitStringHalfBy(rangePart, "-")
+			if from, err = strconv.Atoi(fromPart); err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+			to = from
+			if strings.Contains(rangePart, "-") {
+				if to, err = strconv.Atoi(toPart); err != nil {
+					return 0, fmt.Errorf("invalid value: %s", part)
+				}
+			} else if strings.Contains(part, "/") {
+				// 5/15 - from 5 to max with step
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("value out of range %d-%d: %s", min, max, part)
+		}
+
+		for value := from; value <= to; value += step {
+			result |= 1 << uint(value)
+		}
+	}
+
+	return result, nil
+}
+
+// match - time is matched by cron expression (with minute precision)
+func (spec cronSpec) match(t time.Time) bool {
+	has := func(bitset uint64, value int) bool {
+		return bitset&(1<<uint(value)) != 0
+	}
+
+	dayOfMonth, dayOfWeek := has(spec.dayOfMonth, t.Day()), has(spec.dayOfWeek, int(t.Weekday()))
+	dayMatched := dayOfMonth && dayOfWeek
+	if !spec.anyDayOfMonth && !spec.anyDayOfWeek {
+		// as in cron: day matches if any of day fields matches
+		dayMatched = dayOfMonth || dayOfWeek
+	}
+
+	return dayMatched &&
+		has(spec.minute, t.Minute()) &&
+		has(spec.hour, t.Hour()) &&
+		has(spec.month, int(t.Month()))
+}
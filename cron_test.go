@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseCron(t *testing.T) {
+	// 2024-01-15 is Monday
+	data := []struct {
+		expr  string
+		time  string
+		match bool
+	}{
+		{"* * * * *", "2024-01-15 10:30", true},
+		{"30 10 * * *", "2024-01-15 10:30", true},
+		{"30 10 * * *", "2024-01-15 10:31", false},
+		{"*/15 * * * *", "2024-01-15 10:45", true},
+		{"*/15 * * * *", "2024-01-15 10:40", false},
+		{"0 9-18/3 * * *", "2024-01-15 15:00", true},
+		{"0 9-18/3 * * *", "2024-01-15 16:00", false},
+		{"0 9 * * 1-5", "2024-01-15 09:00", true},
+		{"0 9 * * 1-5", "2024-01-14 09:00", false},
+		{"0 9 * * 7", "2024-01-14 09:00", true},
+		{"0 9 1,15 * *", "2024-01-15 09:00", true},
+		{"0 9 1 * 0", "2024-01-14 09:00", true},
+		{"0 9 1 * 0", "2024-01-15 09:00", false},
+		{"0 0 1 6 *", "2024-01-01 00:00", false},
+		{"@daily", "2024-01-15 00:00", true},
+		{"@hourly", "2024-01-15 10:01", false},
+	}
+
+	for _, item := range data {
+		spec, err := parseCron(item.expr)
+		if err != nil {
+			t.Errorf("Failing for %q: %s", item.expr, err)
+			continue
+		}
+		tm, _ := time.Parse("2006-01-02 15:04", item.time)
+		if match := spec.match(tm); match != item.match {
+			t.Errorf("Failing for %q at %s\nexpected: %v, real: %v", item.expr, item.time, item.match, match)
+		}
+	}
+
+	invalidExprs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every",
+	}
+	for _, expr := range invalidExprs {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Failing check invalid cron expression: %q", expr)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ctlTimeout - timeout for read request from socket and wait for reply (in seconds)
+const ctlTimeout = 10
+
+// ctlMaxRequestSize - max size of request from shell2telegram ctl
+const ctlMaxRequestSize = 1024 * 1024
+
+// ctlRequest - sub-command from shell2telegram ctl, processed in main loop
+type ctlRequest struct {
+	command string      // sub-command with arguments: "ban @user"
+	result  chan string // reply of sub-command
+}
+
+// ctlListen - listen unix socket for requests from shell2telegram ctl,
+// request is a sub-command of /shell2telegram with arguments, connection is closed after reply
+func ctlListen(socketPath string, ctlSignal chan<- ctlRequest) (net.Listener, error) {
+	// remove socket file left after previous run
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// only owner of bot process may administer it
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ctlServe(conn, ctlSignal)
+		}
+	}()
+
+	return listener, nil
+}
+
+// ctlServe - read one request from connection and write reply
+func ctlServe(conn net.Conn, ctlSignal chan<- ctlRequest) {
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(ctlTimeout * time.Second))
+	command, err := ioutil.ReadAll(io.LimitReader(conn, ctlMaxRequestSize))
+	if err != nil {
+		log.Printf("read ctl request failed: %s", err)
+		return
+	}
+
+	request := ctlRequest{command: strings.TrimSpace(string(command)), result: make(chan string, 1)}
+	ctlSignal <- request
+	if _, err = io.WriteString(conn, <-request.result); err != nil {
+		log.Printf("write ctl reply failed: %s", err)
+	}
+}
+
+// runCtl - shell2telegram ctl [-ctl-socket=file] sub-command [args] - send sub-command to running bot and print reply
+func runCtl(args []string, output io.Writer) error {
+	flagSet := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	flagSet.SetOutput(output)
+	socketPath := flagSet.String("ctl-socket", os.Getenv("S2T_CTL_SOCKET"), "unix socket `file` of running bot (or set S2T_CTL_SOCKET variable)")
+	flagSet.Usage = func() {
+		_, _ = fmt.Fprintf(flagSet.Output(), "usage: %s ctl [-ctl-socket=file] sub-command [args]\n%s\n\noptions:\n",
+			os.Args[0],
+			"sub-commands are the same as /shell2telegram sub-commands, and: add </command[:modificators]> <shell command>",
+		)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	if *socketPath == "" {
+		return fmt.Errorf("error: socket file is not set, use -ctl-socket option or S2T_CTL_SOCKET variable")
+	}
+	if flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return fmt.Errorf("error: sub-command is required")
+	}
+
+	conn, err := net.DialTimeout("unix", *socketPath, ctlTimeout*time.Second)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(ctlTimeout * time.Second))
+	if _, err = io.WriteString(conn, strings.Join(flagSet.Args(), " ")); err != nil {
+		return err
+	}
+	// end of request
+	if err = conn.(*net.UnixConn).CloseWrite(); err != nil {
+		return err
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if len(reply) > 0 {
+		_, err = fmt.Fprintln(output, strings.TrimRight(string(reply), "\n"))
+	}
+
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_runCtl(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "ctl.sock")
+	ctlSignal := make(chan ctlRequest)
+	listener, err := ctlListen(socketPath, ctlSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket must be available only for owner: %v, %v", info, err)
+	}
+
+	go func() {
+		for request := range ctlSignal {
+			request.result <- "reply for: " + request.command
+		}
+	}()
+	defer close(ctlSignal)
+
+	data := []struct {
+		args   []string
+		result string
+		err    bool
+	}{
+		{args: []string{"-ctl-socket", socketPath, "ban", "@user"}, result: "reply for: ban @user\n"},
+		{args: []string{"-ctl-socket", socketPath, "send", "@user", "line1\nline2"}, result: "reply for: send @user line1\nline2\n"},
+		{args: []string{"-ctl-socket", socketPath}, err: true},
+		{args: []string{"stat"}, err: true},
+		{args: []string{"-ctl-socket", filepath.Join(dir, "not_exists.sock"), "stat"}, err: true},
+	}
+
+	t.Setenv("S2T_CTL_SOCKET", "")
+	for _, item := range data {
+		output := bytes.Buffer{}
+		err := runCtl(item.args, &output)
+		if item.err != (err != nil) || !item.err && output.String() != item.result {
+			t.Errorf("Failing for %q\nexpected: %q, real: %q, %v", item.args, item.result, output.String(), err)
+		}
+	}
+
+	// socket file from previous run is replaced
+	if err = listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err = ctlListen(socketPath, ctlSignal); err != nil {
+		t.Errorf("listen on stale socket failed: %s", err)
+	} else if err = listener.Close(); err != nil {
+		t.Errorf("close listener failed: %s", err)
+	}
+}
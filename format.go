@@ -0,0 +1,184 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// formats of command output (/cmd:format=pre)
+const (
+	formatMarkdown   = "markdown"   // legacy Markdown, same as /cmd:md
+	formatMarkdownV2 = "markdownv2" // output of command is MarkdownV2 text
+	formatHTML       = "html"       // output of command is HTML text
+	formatPre        = "pre"        // output of command is plain text, send it in monospace block
+)
+
+// formatReserve - reserve in message for closing/reopening entities on the border of messages
+const formatReserve = 256
+
+var htmlTagRe = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)[^>]*>`)
+
+// isValidFormat - check format name for :format modificator
+func isValidFormat(format string) bool {
+	return stringInList(format, []string{formatMarkdown, formatMarkdownV2, formatHTML, formatPre})
+}
+
+// getFormat - format of command output, "" - plain text
+func (cmd Command) getFormat() string {
+	if cmd.format == "" && cmd.isMarkdown {
+		return formatMarkdown
+	}
+	return cmd.format
+}
+
+// formatMessages - split text to messages, every message has complete formatting entities
+func formatMessages(text, format string) (messages []string, parseMode string) {
+	switch format {
+	case formatMarkdown:
+		return splitStringLinesBySize(text, MaxMessageLength), tgbotapi.ModeMarkdown
+	case formatPre:
+		// escaping doesn't add new lines, so escaped text may be split by lines
+		messages = splitStringLinesBySize(escapeHTML(text), MaxMessageLength-len("<pre></pre>"))
+		for i, message := range messages {
+			messages[i] = "<pre>" + message + "</pre>"
+		}
+		return messages, "HTML"
+	case formatHTML:
+		return splitWithEntities(text, trackHTMLTags, closeHTMLTag), "HTML"
+	case formatMarkdownV2:
+		return splitWithEntities(text, trackMarkdownV2Entities, closeMarkdownV2Entity), "MarkdownV2"
+	default:
+		return splitStringLinesBySize(text, MaxMessageLength), ""
+	}
+}
+
+// escapeHTML - escape text for HTML parse mode
+func escapeHTML(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// splitWithEntities - split text by lines, entities which are open on the border of messages
+// are closed at the end of message and reopened at the beginning of next message
+func splitWithEntities(text string, track func(text string, opened []string) []string, closeEntity func(string) string) []string {
+	messages := splitStringLinesBySize(text, MaxMessageLength-formatReserve)
+
+	opened := []string{}
+	for i, message := range messages {
+		prefix := strings.Join(opened, "")
+		opened = track(message, opened)
+
+		suffix := ""
+		for j := len(opened) - 1; j >= 0; j-- {
+			suffix += closeEntity(opened[j])
+		}
+		messages[i] = prefix + message + suffix
+	}
+
+	return messages
+}
+
+// trackHTMLTags - get opening tags which are not closed after text
+func trackHTMLTags(text string, opened []string) []string {
+	result := append([]string{}, opened...)
+
+	for _, match := range htmlTagRe.FindAllStringSubmatch(text, -1) {
+		tag, isClosing, name := match[0], match[1] == "/", strings.ToLower(match[2])
+		if !isClosing {
+			result = append(result, tag)
+			continue
+		}
+		for j := len(result) - 1; j >= 0; j-- {
+			if htmlTagName(result[j]) == name {
+				result = append(result[:j], result[j+1:]...)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// htmlTagName - get name of tag by opening tag
+func htmlTagName(tag string) string {
+	match := htmlTagRe.FindStringSubmatch(tag)
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(match[2])
+}
+
+// closeHTMLTag - get closing tag by opening tag
+func closeHTMLTag(tag string) string {
+	return "</" + htmlTagName(tag) + ">"
+}
+
+// trackMarkdownV2Entities - get entity markers (*, _, __, ~, ||, `, ```lang) which are not closed after text
+func trackMarkdownV2Entities(text string, opened []string) []string {
+	result := append([]string{}, opened...)
+
+	// toggle - close entity if it is open, open otherwise
+	toggle := func(marker string) {
+		for j := len(result) - 1; j >= 0; j-- {
+			if result[j] == marker {
+				result = append(result[:j], result[j+1:]...)
+				return
+			}
+		}
+		result = append(result, marker)
+	}
+
+	for i := 0; i < len(text); {
+		inCode := ""
+		if len(result) > 0 && strings.HasPrefix(result[len(result)-1], "`") {
+			inCode = result[len(result)-1]
+		}
+
+		switch {
+		case text[i] == '\\':
+			i += 2
+		case inCode != "" && inCode != "`" && strings.HasPrefix(text[i:], "```"):
+			result = result[:len(result)-1]
+			i += 3
+		case inCode == "`" && text[i] == '`':
+			result = result[:len(result)-1]
+			i++
+		case inCode != "":
+			// no entities inside code
+			i++
+		case strings.HasPrefix(text[i:], "```"):
+			// pre block with optional language: ```go\n
+			end := strings.IndexByte(text[i:], '\n')
+			if end == -1 {
+				result = append(result, text[i:]+"\n")
+				i = len(text)
+			} else {
+				result = append(result, text[i:i+end+1])
+				i += end + 1
+			}
+		case strings.HasPrefix(text[i:], "||"), strings.HasPrefix(text[i:], "__"):
+			toggle(text[i : i+2])
+			i += 2
+		case strings.ContainsRune("*_~`", rune(text[i])):
+			if text[i] == '`' {
+				result = append(result, "`")
+			} else {
+				toggle(text[i : i+1])
+			}
+			i++
+		default:
+			i++
+		}
+	}
+
+	return result
+}
+
+// closeMarkdownV2Entity - get closing marker by opening marker
+func closeMarkdownV2Entity(marker string) string {
+	if strings.HasPrefix(marker, "```") {
+		return "\n```"
+	}
+	return marker
+}
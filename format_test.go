@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_formatMessages(t *testing.T) {
+	longLines := strings.TrimSuffix(strings.Repeat(strings.Repeat("x", 99)+"\n", 50), "\n")
+
+	data := []struct {
+		text      string
+		format    string
+		messages  []string
+		parseMode string
+	}{
+		{"a *b*", "", []string{"a *b*"}, ""},
+		{"a *b*", formatMarkdown, []string{"a *b*"}, "Markdown"},
+		{"a < b && c > d", formatPre, []string{"<pre>a &lt; b &amp;&amp; c &gt; d</pre>"}, "HTML"},
+		{"<b>bold</b>", formatHTML, []string{"<b>bold</b>"}, "HTML"},
+		{"*bold*", formatMarkdownV2, []string{"*bold*"}, "MarkdownV2"},
+		{
+			"<b><a href=\"http://a\">" + longLines + "</a></b>", formatHTML,
+			[]string{
+				"<b><a href=\"http://a\">" + longLines[:3799] + "</a></b>",
+				"<b><a href=\"http://a\">" + longLines[3800:] + "</a></b>",
+			},
+			"HTML",
+		},
+		{
+			"```go\n" + longLines + "\n```", formatMarkdownV2,
+			[]string{
+				"```go\n" + longLines[:3799] + "\n```",
+				"```go\n" + longLines[3800:] + "\n```",
+			},
+			"MarkdownV2",
+		},
+	}
+
+	for _, item := range data {
+		messages, parseMode := formatMessages(item.text, item.format)
+		if fmt.Sprintf("%q", messages) != fmt.Sprintf("%q", item.messages) || parseMode != item.parseMode {
+			t.Errorf("Failing for %q (format: %s)\nexpected: %q, %s\nreal: %q, %s", item.text, item.format, item.messages, item.parseMode, messages, parseMode)
+		}
+	}
+}
+
+func Test_trackMarkdownV2Entities(t *testing.T) {
+	data := []struct {
+		text   string
+		opened []string
+		result []string
+	}{
+		{"*bold* _italic_", nil, []string{}},
+		{"*bold _italic", nil, []string{"*", "_"}},
+		{"still bold* and __underline", []string{"*"}, []string{"__"}},
+		{"\\*not bold ||spoiler", nil, []string{"||"}},
+		{"`code * _`", nil, []string{}},
+		{"```\ncode *", nil, []string{"```\n"}},
+		{"code *\n```", []string{"```\n"}, []string{}},
+	}
+
+	for _, item := range data {
+		result := trackMarkdownV2Entities(item.text, item.opened)
+		if fmt.Sprintf("%q", result) != fmt.Sprintf("%q", item.result) {
+			t.Errorf("Failing for %q (opened: %q)\nexpected: %q, real: %q", item.text, item.opened, item.result, result)
+		}
+	}
+}
@@ -8,4 +8,5 @@ require (
 	github.com/msoap/raphanus v0.14.0
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
 	gopkg.in/telegram-bot-api.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
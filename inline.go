@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// MaxInlineResults - max count of results for one inline query (limit of Telegram Bot API)
+const MaxInlineResults = 50
+
+// jsonInlineResult - one result of inline query from JSON output of /:inline command
+type jsonInlineResult struct {
+	Title       string `json:"title"`       // title of result in list
+	Text        string `json:"text"`        // text of message, default - title
+	Description string `json:"description"` // short description under title
+	URL         string `json:"url"`         // URL of result
+	Format      string `json:"format"`      // format of text: markdown, markdownv2, html, pre
+}
+
+// parseInlineResults - parse output of /:inline command: result per line (title is text of message),
+// or JSON (array of objects or one object per line) with title, text, description, url and format fields
+func parseInlineResults(output []byte) (results []InlineQueryResultArticle, err error) {
+	output = bytes.TrimSpace(output)
+	items := []jsonInlineResult{}
+
+	switch {
+	case len(output) > 0 && output[0] == '[':
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&items); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %s", err)
+		}
+	case len(output) > 0 && output[0] == '{':
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		decoder.DisallowUnknownFields()
+		for {
+			item := jsonInlineResult{}
+			if err = decoder.Decode(&item); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("result #%d: invalid JSON: %s", len(items)+1, err)
+			}
+			items = append(items, item)
+		}
+	default:
+		for _, line := range strings.Split(string(output), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				items = append(items, jsonInlineResult{Title: line})
+			}
+		}
+	}
+
+	if len(items) > MaxInlineResults {
+		items = items[:MaxInlineResults]
+	}
+
+	for i, item := range items {
+		if item.Text == "" {
+			item.Text = item.Title
+		}
+		switch {
+		case item.Title == "":
+			return nil, fmt.Errorf("result #%d: title is required", i+1)
+		case item.Format != "" && !isValidFormat(item.Format):
+			return nil, fmt.Errorf("result #%d: unknown format: %s", i+1, item.Format)
+		}
+
+		messages, parseMode := formatMessages(item.Text, item.Format)
+		if len(messages) != 1 || len([]rune(messages[0])) > MaxMessageLength {
+			return nil, fmt.Errorf("result #%d: text is longer than %d characters", i+1, MaxMessageLength)
+		}
+
+		results = append(results, InlineQueryResultArticle{
+			Type:                "article",
+			ID:                  strconv.Itoa(i + 1),
+			Title:               item.Title,
+			Description:         item.Description,
+			URL:                 item.URL,
+			InputMessageContent: InputTextMessageContent{MessageText: messages[0], ParseMode: parseMode},
+		})
+	}
+
+	return results, nil
+}
+
+// cmdInlineQuery - run /:inline command with text of inline query (@bot query) in STDIN
+// and answer with results, not authorized users get empty results
+func cmdInlineQuery(ctx Ctx, query tgbotapi.InlineQuery) {
+	answer := func(results []InlineQueryResultArticle, cacheTime int) {
+		go func() {
+			ctx.messageSignal <- BotMessage{
+				messageType:   msgIsInlineAnswer,
+				inlineQueryID: query.ID,
+				inlineResults: results,
+				cacheTime:     cacheTime,
+			}
+		}()
+	}
+
+	cmd, found := ctx.commands[cmdInline]
+	if !found || !ctx.allowExec || !isAllowedCommand(ctx, cmd) {
+		answer(nil, 0)
+		return
+	}
+	if usageMsg := checkArgs(cmdInline, cmd, query.Query); usageMsg != "" {
+		answer(nil, 0)
+		return
+	}
+
+	ctx.cacheTTL = commandOption(cmd.cache, ctx.appConfig.cache)
+	shellUser := ctx.users.ShellUser(ctx.userID, 0)
+
+	go func() {
+		job := Job{userID: ctx.userID, command: cmdInline, args: query.Query}
+		output, status := runJob(ctx, job, cmd, query.Query, nil, nil, shellUser)
+		if status.err != nil {
+			log.Printf("inline query %q failed: %s", query.Query, status)
+			answer(nil, 0)
+			return
+		}
+
+		results, err := parseInlineResults(output)
+		if err != nil {
+			log.Printf("inline query %q: %s", query.Query, err)
+			answer(nil, 0)
+			return
+		}
+		answer(results, ctx.cacheTTL)
+	}()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/msoap/raphanus"
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+func Test_parseInlineResults(t *testing.T) {
+	article := func(id, title, text, parseMode string) InlineQueryResultArticle {
+		return InlineQueryResultArticle{
+			Type:                "article",
+			ID:                  id,
+			Title:               title,
+			InputMessageContent: InputTextMessageContent{MessageText: text, ParseMode: parseMode},
+		}
+	}
+	withDescription := article("1", "Nginx", "restart: systemctl restart nginx", "")
+	withDescription.Description, withDescription.URL = "runbook", "https://wiki/nginx"
+
+	data := []struct {
+		output  string
+		results []InlineQueryResultArticle
+		err     string
+	}{
+		{
+			output:  "nginx restart\n\n  disk full  \n",
+			results: []InlineQueryResultArticle{article("1", "nginx restart", "nginx restart", ""), article("2", "disk full", "disk full", "")},
+		},
+		{output: "", results: nil},
+		{
+			output:  `[{"title": "Nginx", "text": "restart: systemctl restart nginx", "description": "runbook", "url": "https://wiki/nginx"}]`,
+			results: []InlineQueryResultArticle{withDescription},
+		},
+		{
+			output:  "{\"title\": \"Disk\", \"text\": \"df -h\", \"format\": \"pre\"}\n{\"title\": \"Load\"}",
+			results: []InlineQueryResultArticle{article("1", "Disk", "<pre>df -h</pre>", "HTML"), article("2", "Load", "Load", "")},
+		},
+		{output: strings.Repeat("line\n", MaxInlineResults+10), results: nil},
+		{output: `[{"title": "one"`, err: "invalid JSON: unexpected EOF"},
+		{output: "{\"title\": \"one\"}\n{\"name\": \"two\"}", err: `result #2: invalid JSON: json: unknown field "name"`},
+		{output: `[{"text": "one"}]`, err: "result #1: title is required"},
+		{output: `[{"title": "one", "format": "rtf"}]`, err: "result #1: unknown format: rtf"},
+		{output: `[{"title": "one", "text": "` + strings.Repeat("x", MaxMessageLength+1) + `"}]`, err: "result #1: text is longer than 4096 characters"},
+	}
+
+	for i, item := range data {
+		results, err := parseInlineResults([]byte(item.output))
+		if item.err != "" {
+			if err == nil || err.Error() != item.err {
+				t.Errorf("%d. Failing for %q\nexpected error: %q, real: %v", i, item.output, item.err, err)
+			}
+			continue
+		}
+		if i == 4 {
+			if len(results) != MaxInlineResults {
+				t.Errorf("%d. results must be limited by %d: %d", i, MaxInlineResults, len(results))
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(results, item.results) {
+			t.Errorf("%d. Failing for %q\nexpected: %#v, real: %#v, %v", i, item.output, item.results, results, err)
+		}
+	}
+}
+
+func Test_cmdInlineQuery(t *testing.T) {
+	users := Users{list: map[int]*User{
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+		3: {UserID: 3, UserName: "user3"},
+	}}
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+	_, command, _ := parseBotCommand("/:inline:cache=60", "echo $RANDOM-$$; grep -i \"$(cat)\"; printf 'nginx restart\\ndisk full\\n' | grep -i nginx")
+
+	ctx := Ctx{
+		appConfig:      &Config{shell: "sh"},
+		users:          &users,
+		commands:       Commands{cmdInline: command},
+		userID:         2,
+		allowExec:      true,
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+	}
+
+	cmdInlineQuery(ctx, tgbotapi.InlineQuery{ID: "q1", Query: "nginx"})
+	answer := <-messageSignal
+	if answer.messageType != msgIsInlineAnswer || answer.inlineQueryID != "q1" || len(answer.inlineResults) != 2 ||
+		answer.inlineResults[1].Title != "nginx restart" || answer.cacheTime != 60 {
+		t.Errorf("1. inline query failed: %#v", answer)
+	}
+
+	// output is cached
+	cmdInlineQuery(ctx, tgbotapi.InlineQuery{ID: "q2", Query: "nginx"})
+	if cached := <-messageSignal; !reflect.DeepEqual(cached.inlineResults, answer.inlineResults) {
+		t.Errorf("2. inline query must be cached: %#v", cached)
+	}
+
+	notAuthorizedCtx := ctx
+	notAuthorizedCtx.userID, notAuthorizedCtx.allowExec = 3, false
+	cmdInlineQuery(notAuthorizedCtx, tgbotapi.InlineQuery{ID: "q3", Query: "nginx"})
+	if answer := <-messageSignal; answer.inlineQueryID != "q3" || len(answer.inlineResults) != 0 {
+		t.Errorf("3. not authorized user must get empty results: %#v", answer)
+	}
+}
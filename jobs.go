@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job - running shell command
+type Job struct {
+	ID        int                // job ID for /kill
+	userID    int                // user who started command
+	chatID    int                // chat where command was started
+	command   string             // bot command
+	args      string             // command arguments
+	startedAt time.Time          // start time of job
+	pid       int                // PID of shell process, 0 if process is not started yet
+	cancel    context.CancelFunc // for stop command
+}
+
+// Jobs - registry of running shell commands, used from command goroutines and main loop
+type Jobs struct {
+	mutex  sync.Mutex
+	lastID int
+	list   map[int]*Job
+}
+
+// NewJobs - create Jobs object
+func NewJobs() *Jobs {
+	return &Jobs{list: map[int]*Job{}}
+}
+
+// Add - register new job, returns context for shell command and job ID
+func (jobs *Jobs) Add(job Job) (context.Context, int) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs.lastID++
+	job.ID, job.startedAt, job.cancel = jobs.lastID, time.Now(), cancel
+	jobs.list[job.ID] = &job
+
+	return ctx, job.ID
+}
+
+// SetPID - set PID of started shell process
+func (jobs *Jobs) SetPID(id, pid int) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	if job, ok := jobs.list[id]; ok {
+		job.pid = pid
+	}
+}
+
+// Remove - remove finished job
+func (jobs *Jobs) Remove(id int) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	if job, ok := jobs.list[id]; ok {
+		job.cancel()
+		delete(jobs.list, id)
+	}
+}
+
+// List - get jobs sorted by ID, for userID == 0 - jobs of all users
+func (jobs *Jobs) List(userID int) []Job {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	result := []Job{}
+	for _, job := range jobs.list {
+		if userID == 0 || job.userID == userID {
+			result = append(result, *job)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// Kill - stop job, user may stop only own jobs, userID == 0 - any job
+func (jobs *Jobs) Kill(id, userID int) error {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	job, ok := jobs.list[id]
+	if !ok || userID != 0 && job.userID != userID {
+		return fmt.Errorf("job #%d not found", id)
+	}
+	job.cancel()
+
+	return nil
+}
+
+// String - format job for list
+func (job Job) String() string {
+	state := "waiting"
+	if job.pid != 0 {
+		state = fmt.Sprintf("pid %d", job.pid)
+	}
+
+	return fmt.Sprintf("#%d %s (%s, %s)",
+		job.ID,
+		strings.TrimSpace(job.command+" "+job.args),
+		time.Since(job.startedAt).Round(time.Second),
+		state,
+	)
+}
+
+// runJob - run shell command as job, which may be listed by /jobs and stopped by /kill,
+// with -one-thread commands wait for each other
+func runJob(ctx Ctx, job Job, cmd Command, input string, extraEnv []string, stream io.Writer, user ShellUser) ([]byte, execStatus) {
+	jobCtx, jobID := ctx.jobs.Add(job)
+	defer ctx.jobs.Remove(jobID)
+
+	if ctx.appConfig.oneThread {
+		ctx.oneThreadMutex.Lock()
+		defer ctx.oneThreadMutex.Unlock()
+	}
+
+	return execShell(
+		jobCtx,
+		cmd,
+		input,
+		extraEnv,
+		stream,
+		func(pid int) { ctx.jobs.SetPID(jobID, pid) },
+		user,
+		ctx.cache,
+		ctx.cacheTTL,
+		ctx.appConfig,
+	)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msoap/raphanus"
+)
+
+func Test_Jobs(t *testing.T) {
+	jobs := NewJobs()
+	ctx1, id1 := jobs.Add(Job{userID: 1, command: "/build", args: "app"})
+	_, id2 := jobs.Add(Job{userID: 2, command: "/deploy"})
+	jobs.SetPID(id1, 1234)
+
+	if list := jobs.List(1); len(list) != 1 || list[0].ID != id1 || list[0].pid != 1234 {
+		t.Errorf("1. List for user failed: %#v", list)
+	}
+	if list := jobs.List(0); len(list) != 2 || list[0].ID != id1 || list[1].ID != id2 {
+		t.Errorf("2. List for all failed: %#v", list)
+	}
+	if str := jobs.List(1)[0].String(); !strings.HasPrefix(str, "#1 /build app (") || !strings.HasSuffix(str, ", pid 1234)") {
+		t.Errorf("3. String failed: %s", str)
+	}
+
+	if err := jobs.Kill(id1, 2); err == nil || ctx1.Err() != nil {
+		t.Errorf("4. Kill job of other user must fail")
+	}
+	if err := jobs.Kill(id1, 1); err != nil || ctx1.Err() == nil {
+		t.Errorf("5. Kill own job failed: %v", err)
+	}
+	if err := jobs.Kill(id2, 0); err != nil {
+		t.Errorf("6. Kill any job by root failed: %v", err)
+	}
+
+	jobs.Remove(id1)
+	jobs.Remove(id2)
+	if list := jobs.List(0); len(list) != 0 {
+		t.Errorf("7. Remove failed: %#v", list)
+	}
+}
+
+func Test_cmdKill(t *testing.T) {
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+	users := Users{list: map[int]*User{
+		1: {UserID: 1, UserName: "user1", IsAuthorized: true},
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+	}}
+	_, command, _ := parseBotCommand("/sleep", "echo started; sleep 10")
+
+	ctx := Ctx{
+		appConfig:      &Config{shell: "sh"},
+		users:          &users,
+		commands:       Commands{"/sleep": command},
+		userID:         1,
+		chatID:         100,
+		allowExec:      true,
+		messageCmd:     "/sleep",
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+	}
+
+	cmdUser(ctx)
+	for i := 0; i < 100 && (len(ctx.jobs.List(1)) == 0 || ctx.jobs.List(1)[0].pid == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if jobsMsg := cmdJobs(ctx); !strings.HasPrefix(jobsMsg, "#1 /sleep (") {
+		t.Fatalf("1. /jobs failed: %s", jobsMsg)
+	}
+
+	otherCtx := ctx
+	otherCtx.userID, otherCtx.messageArgs = 2, "1"
+	if replayMsg := cmdKill(otherCtx); replayMsg != "job #1 not found" {
+		t.Errorf("2. /kill job of other user: %s", replayMsg)
+	}
+
+	ctx.messageArgs = "1"
+	if replayMsg := cmdKill(ctx); replayMsg != "Job #1 stopped" {
+		t.Errorf("3. /kill failed: %s", replayMsg)
+	}
+	if message := <-messageSignal; !regexp.MustCompile(`^started\n\nkilled after \d+s$`).MatchString(message.message) {
+		t.Errorf("4. output of killed command: %#v", message)
+	}
+	if jobsMsg := cmdJobs(ctx); jobsMsg != "No running commands" {
+		t.Errorf("5. /jobs after kill: %s", jobsMsg)
+	}
+}
+
+func Test_cmdKillWaitingJob(t *testing.T) {
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+	_, command, _ := parseBotCommand("/echo", "echo started")
+
+	ctx := Ctx{
+		appConfig:      &Config{shell: "sh", oneThread: true},
+		users:          &Users{list: map[int]*User{1: {UserID: 1, UserName: "user1", IsAuthorized: true}}},
+		commands:       Commands{"/echo": command},
+		userID:         1,
+		chatID:         100,
+		allowExec:      true,
+		messageCmd:     "/echo",
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+	}
+
+	// other command is running, job waits for it
+	ctx.oneThreadMutex.Lock()
+	cmdUser(ctx)
+	for i := 0; i < 100 && len(ctx.jobs.List(1)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx.messageArgs = "1"
+	if replayMsg := cmdKill(ctx); replayMsg != "Job #1 stopped" {
+		t.Errorf("1. /kill of waiting job failed: %s", replayMsg)
+	}
+	ctx.oneThreadMutex.Unlock()
+
+	if message := <-messageSignal; !regexp.MustCompile(`^killed after \d+s$`).MatchString(message.message) {
+		t.Errorf("2. output of killed waiting job: %#v", message)
+	}
+
+	// process of killed job is not started
+	jobCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := false
+	_, status := execShell(jobCtx, command, "", nil, nil, func(int) { started = true }, ShellUser{userID: 1, chatID: 100}, &cache, 0, ctx.appConfig)
+	if started || !status.killed {
+		t.Errorf("3. killed job must not be started: %#v", status)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// MaxMenuCommands - max count of commands in bot menu (limit of Telegram Bot API)
+const MaxMenuCommands = 100
+
+// MaxMenuDescriptionLength - max length of command description in bot menu
+const MaxMenuDescriptionLength = 256
+
+// DefaultMenuDescription - description of command without :desc in menu for not root users
+const DefaultMenuDescription = "run command"
+
+// botMenu - commands of bot menu by scope: all chats, private chats, private chats of root users
+type botMenu map[BotCommandScope][]BotCommand
+
+// menuCommandName - command names which Telegram accepts in bot menu
+var menuCommandName = regexp.MustCompile(`^/[a-z0-9_]{1,32}$`)
+
+// getBotMenu - get bot menu for commands and users, commands restricted by users, roles, chats or root
+// and /shell2telegram are shown only for root users, commands which Telegram does not accept (/:inline, /Cmd) are skipped,
+// shell command instead of missing description is shown only for root users (or for all with -allow-all)
+func getBotMenu(commands Commands, users Users, appConfig Config) botMenu {
+	publicCommands, rootCommands := []BotCommand{}, []BotCommand{}
+	for path, cmd := range commands {
+		if !menuCommandName.MatchString(path) {
+			continue
+		}
+
+		rootCommands = append(rootCommands, BotCommand{Command: path[1:], Description: menuDescription(cmd, true)})
+		if !cmd.rootOnly && len(cmd.allowUsers) == 0 && len(cmd.allowRoles) == 0 && len(cmd.allowChats) == 0 {
+			publicCommands = append(publicCommands, BotCommand{Command: path[1:], Description: menuDescription(cmd, appConfig.allowAll)})
+		}
+	}
+
+	builtIn := []BotCommand{{Command: "help", Description: "list of available commands"}}
+	for _, command := range []BotCommand{{"jobs", "list of your running commands"}, {"kill", "stop running command: /kill <job_id>"}} {
+		if _, exists := commands["/"+command.Command]; !exists {
+			builtIn = append(builtIn, command)
+		}
+	}
+	authCommands := []BotCommand{}
+	if !appConfig.isPublicBot {
+		authCommands = []BotCommand{{"auth", "authorize user"}, {"authroot", "authorize user as root"}}
+	}
+
+	defaultMenu := sortBotCommands(append(append([]BotCommand{}, publicCommands...), builtIn...))
+	privateMenu := sortBotCommands(append(append(append([]BotCommand{}, publicCommands...), builtIn...), authCommands...))
+	rootMenu := sortBotCommands(append(append(append(rootCommands, builtIn...), authCommands...),
+		BotCommand{Command: "shell2telegram", Description: "bot administration: stat, search, ban, auth, rm, reload, ps, schedule, ..."},
+	))
+
+	menu := botMenu{
+		{Type: "default"}:           defaultMenu,
+		{Type: "all_private_chats"}: privateMenu,
+	}
+	for _, user := range users.list {
+		if user.IsRoot && user.PrivateChatID > 0 {
+			menu[BotCommandScope{Type: "chat", ChatID: user.PrivateChatID}] = rootMenu
+		}
+	}
+
+	return menu
+}
+
+// menuDescription - description of command for menu, shell command is used if description is not set and showShell is true
+func menuDescription(cmd Command, showShell bool) string {
+	description := cmd.description
+	switch {
+	case description == "" && showShell:
+		description = cmd.shellCmd
+	case description == "":
+		description = DefaultMenuDescription
+	}
+	if descriptionRunes := []rune(description); len(descriptionRunes) > MaxMenuDescriptionLength {
+		description = string(descriptionRunes[:MaxMenuDescriptionLength-1]) + "…"
+	}
+	return description
+}
+
+// sortBotCommands - sort commands by name and limit count of commands
+func sortBotCommands(commands []BotCommand) []BotCommand {
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Command < commands[j].Command
+	})
+	if len(commands) > MaxMenuCommands {
+		commands = commands[:MaxMenuCommands]
+	}
+	return commands
+}
+
+// diff - get changed scopes of menu and scopes which were removed since previous menu
+func (menu botMenu) diff(previous botMenu) (changed botMenu, removed []BotCommandScope) {
+	changed = botMenu{}
+	for scope, commands := range menu {
+		if previousCommands, ok := previous[scope]; !ok || !reflect.DeepEqual(commands, previousCommands) {
+			changed[scope] = commands
+		}
+	}
+	for scope := range previous {
+		if _, ok := menu[scope]; !ok {
+			removed = append(removed, scope)
+		}
+	}
+
+	return changed, removed
+}
+
+// publishBotMenu - send changes of bot menu to Telegram, menus are sent by main loop when commands or root users are changed
+func publishBotMenu(transport Transport, menuSignal <-chan botMenu) {
+	published := botMenu{}
+	for menu := range menuSignal {
+		changed, removed := menu.diff(published)
+		for scope, commands := range changed {
+			if err := transport.SetMenu(scope, commands); err != nil {
+				log.Printf("set bot menu for %s scope failed: %s", scope.Type, err)
+				continue
+			}
+			published[scope] = commands
+		}
+		for _, scope := range removed {
+			if err := transport.DeleteMenu(scope); err != nil {
+				log.Printf("delete bot menu for %s scope failed: %s", scope.Type, err)
+				continue
+			}
+			delete(published, scope)
+		}
+		if len(changed) > 0 || len(removed) > 0 {
+			log.Printf("bot menu updated: %d scopes changed, %d scopes removed", len(changed), len(removed))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_getBotMenu(t *testing.T) {
+	commands := Commands{
+		"/date":      {shellCmd: "date"},
+		"/df":        {shellCmd: "df -h", description: "Disk usage"},
+		"/reboot":    {shellCmd: "sudo reboot", rootOnly: true},
+		"/deploy":    {shellCmd: "make deploy", allowRoles: []string{"ops"}},
+		"/kill":      {shellCmd: "pkill app"},
+		"/Upper":     {shellCmd: "date"},
+		cmdPlainText: {shellCmd: "cat"},
+		cmdInline:    {shellCmd: "grep -r ."},
+		"/long":      {shellCmd: strings.Repeat("x", MaxMenuDescriptionLength+10)},
+	}
+	users := Users{list: map[int]*User{
+		1: {UserID: 1, IsRoot: true, PrivateChatID: 11},
+		2: {UserID: 2, IsAuthorized: true, PrivateChatID: 22},
+		3: {UserID: 3, IsRoot: true},
+	}}
+
+	names := func(commands []BotCommand) string {
+		result := []string{}
+		for _, command := range commands {
+			result = append(result, command.Command)
+		}
+		return strings.Join(result, ",")
+	}
+
+	menu := getBotMenu(commands, users, Config{})
+	expected := map[BotCommandScope]string{
+		{Type: "default"}:           "date,df,help,jobs,kill,long",
+		{Type: "all_private_chats"}: "auth,authroot,date,df,help,jobs,kill,long",
+		{Type: "chat", ChatID: 11}:  "auth,authroot,date,deploy,df,help,jobs,kill,long,reboot,shell2telegram",
+	}
+	if len(menu) != len(expected) {
+		t.Errorf("1. getBotMenu() scopes failed: %#v", menu)
+	}
+	for scope, commandNames := range expected {
+		if names(menu[scope]) != commandNames {
+			t.Errorf("2. getBotMenu() failed for %#v\nexpected: %s, real: %s", scope, commandNames, names(menu[scope]))
+		}
+	}
+
+	// shell commands are shown only for root users
+	for _, command := range menu[BotCommandScope{Type: "default"}] {
+		switch {
+		case command.Command == "df" && command.Description != "Disk usage",
+			command.Command == "kill" && command.Description != DefaultMenuDescription,
+			command.Command == "long" && command.Description != DefaultMenuDescription:
+			t.Errorf("3. description failed: %#v", command)
+		}
+	}
+	for _, command := range menu[BotCommandScope{Type: "chat", ChatID: 11}] {
+		switch {
+		case command.Command == "df" && command.Description != "Disk usage",
+			command.Command == "kill" && command.Description != "pkill app",
+			command.Command == "reboot" && command.Description != "sudo reboot",
+			command.Command == "long" && len([]rune(command.Description)) != MaxMenuDescriptionLength:
+			t.Errorf("3. description for root failed: %#v", command)
+		}
+	}
+
+	allowAllMenu := getBotMenu(commands, users, Config{allowAll: true})
+	for _, command := range allowAllMenu[BotCommandScope{Type: "all_private_chats"}] {
+		if command.Command == "kill" && command.Description != "pkill app" {
+			t.Errorf("4. description with -allow-all failed: %#v", command)
+		}
+	}
+
+	if publicMenu := getBotMenu(commands, users, Config{isPublicBot: true}); names(publicMenu[BotCommandScope{Type: "all_private_chats"}]) != "date,df,help,jobs,kill,long" {
+		t.Errorf("5. getBotMenu() for public bot failed: %#v", publicMenu)
+	}
+}
+
+func Test_botMenuDiff(t *testing.T) {
+	previous := botMenu{
+		{Type: "default"}:          {{Command: "date", Description: "date"}},
+		{Type: "chat", ChatID: 11}: {{Command: "date", Description: "date"}},
+	}
+	menu := botMenu{
+		{Type: "default"}:           {{Command: "date", Description: "date"}},
+		{Type: "all_private_chats"}: {{Command: "auth", Description: "authorize user"}},
+	}
+
+	changed, removed := menu.diff(previous)
+	if !reflect.DeepEqual(changed, botMenu{{Type: "all_private_chats"}: {{Command: "auth", Description: "authorize user"}}}) {
+		t.Errorf("1. diff() changed failed: %#v", changed)
+	}
+	if !reflect.DeepEqual(removed, []BotCommandScope{{Type: "chat", ChatID: 11}}) {
+		t.Errorf("2. diff() removed failed: %#v", removed)
+	}
+
+	if changed, removed := menu.diff(menu); len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("3. diff() for same menu failed: %#v, %#v", changed, removed)
+	}
+}
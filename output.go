@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// jsonReply - one reply from command with :output=json
+type jsonReply struct {
+	Text     string         `json:"text"`     // text of message or caption of photo/document
+	Format   string         `json:"format"`   // format of text: markdown, markdownv2, html, pre
+	Photo    string         `json:"photo"`    // path of image file
+	Document string         `json:"document"` // path of file
+	Buttons  [][]jsonButton `json:"buttons"`  // rows of inline buttons with links or bot commands
+	ReplyTo  int            `json:"reply_to"` // ID of message for reply, user message ID is in S2T_MESSAGE_ID variable
+	Silent   bool           `json:"silent"`   // send without notification
+}
+
+// jsonButton - inline button of reply, opens link or runs bot command
+type jsonButton struct {
+	Text    string `json:"text"`
+	URL     string `json:"url"`
+	Command string `json:"command"` // bot command, like "/restart"
+	Args    string `json:"args"`    // arguments of command
+}
+
+// parseJSONOutput - parse output of command with :output=json: one object, array of objects or JSON lines
+func parseJSONOutput(output []byte) (replies []jsonReply, err error) {
+	output = bytes.TrimSpace(output)
+	if len(output) > 0 && output[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&replies); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %s", err)
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("invalid JSON: unexpected data after array")
+		}
+		return replies, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.DisallowUnknownFields()
+	for {
+		reply := jsonReply{}
+		if err = decoder.Decode(&reply); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reply #%d: invalid JSON: %s", len(replies)+1, err)
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
+// messages - validate reply and convert it to messages, files are read from disk,
+// actions for command buttons are saved in callbacks, callback data of button contains only ID of action
+func (reply jsonReply) messages(ctx Ctx) (messages []BotMessage, err error) {
+	chatID := ctx.chatID
+	switch {
+	case reply.Photo != "" && reply.Document != "":
+		return nil, fmt.Errorf("photo and document cannot be in one reply")
+	case reply.Text == "" && reply.Photo == "" && reply.Document == "":
+		return nil, fmt.Errorf("text, photo or document is required")
+	case reply.Format != "" && !isValidFormat(reply.Format):
+		return nil, fmt.Errorf("unknown format: %s", reply.Format)
+	case reply.Format != "" && reply.Text != "" && (reply.Photo != "" || reply.Document != ""):
+		return nil, fmt.Errorf("format is supported only for text without photo or document")
+	case reply.ReplyTo < 0:
+		return nil, fmt.Errorf("reply_to must be a message ID: %d", reply.ReplyTo)
+	}
+
+	var replyMarkup interface{}
+	if len(reply.Buttons) > 0 {
+		keyboard := InlineKeyboardMarkup{}
+		for _, row := range reply.Buttons {
+			keyboardRow := []InlineKeyboardButton{}
+			for _, button := range row {
+				keyboardButton, err := button.keyboardButton(ctx)
+				if err != nil {
+					return nil, err
+				}
+				keyboardRow = append(keyboardRow, keyboardButton)
+			}
+			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, keyboardRow)
+		}
+		replyMarkup = keyboard
+	}
+
+	if reply.Photo == "" && reply.Document == "" {
+		chunks, parseMode := formatMessages(reply.Text, reply.Format)
+		for i, chunk := range chunks {
+			message := BotMessage{chatID: chatID, messageType: msgIsText, message: chunk, parseMode: parseMode, silent: reply.Silent}
+			if i == 0 {
+				message.replyToID = reply.ReplyTo
+			}
+			if i == len(chunks)-1 {
+				// buttons under the last part of long text
+				message.replyMarkup = replyMarkup
+			}
+			messages = append(messages, message)
+		}
+		return messages, nil
+	}
+
+	if len([]rune(reply.Text)) > MaxCaptionLength {
+		return nil, fmt.Errorf("caption is longer than %d characters", MaxCaptionLength)
+	}
+
+	filePath, messageType := reply.Document, msgIsDocument
+	if reply.Photo != "" {
+		filePath, messageType = reply.Photo, msgIsPhoto
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > apiMaxRequestSize {
+		return nil, fmt.Errorf("file %s is too large (max %d bytes)", filePath, apiMaxRequestSize)
+	}
+	fileData, err := ioutil.ReadFile(filePath) // #nosec
+	if err != nil {
+		return nil, err
+	}
+
+	return []BotMessage{{
+		chatID:      chatID,
+		messageType: messageType,
+		fileName:    filepath.Base(filePath),
+		fileData:    fileData,
+		caption:     reply.Text,
+		replyMarkup: replyMarkup,
+		replyToID:   reply.ReplyTo,
+		silent:      reply.Silent,
+	}}, nil
+}
+
+// keyboardButton - validate button and convert it to inline keyboard button
+func (button jsonButton) keyboardButton(ctx Ctx) (InlineKeyboardButton, error) {
+	switch {
+	case button.Text == "":
+		return InlineKeyboardButton{}, fmt.Errorf("text of button is required")
+	case button.URL != "" && button.Command != "":
+		return InlineKeyboardButton{}, fmt.Errorf("button %q: url and command cannot be in one button", button.Text)
+	case button.Command != "":
+		if _, ok := ctx.commands[button.Command]; !ok {
+			return InlineKeyboardButton{}, fmt.Errorf("button %q: command %s not found", button.Text, button.Command)
+		}
+		id := ctx.callbacks.Add(callbackAction{
+			chatID:  ctx.chatID,
+			command: button.Command,
+			args:    button.Args,
+		}, ctx.appConfig.buttonTimeout)
+		return InlineKeyboardButton{Text: button.Text, CallbackData: id + ":cmd"}, nil
+	case !regexp.MustCompile(`^(https?|tg)://\S+$`).MatchString(button.URL):
+		return InlineKeyboardButton{}, fmt.Errorf("button %q: url must be http(s):// or tg:// link: %q", button.Text, button.URL)
+	}
+
+	return InlineKeyboardButton{Text: button.Text, URL: button.URL}, nil
+}
+
+// jsonOutputMessages - get messages from output of command with :output=json
+func jsonOutputMessages(ctx Ctx, output []byte) (messages []BotMessage, err error) {
+	replies, err := parseJSONOutput(output)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, reply := range replies {
+		replyMessages, err := reply.messages(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reply #%d: %s", i+1, err)
+		}
+		messages = append(messages, replyMessages...)
+	}
+
+	return messages, nil
+}
+
+// sendJSONOutput - send replies from output of command with :output=json, nothing is sent if any reply is invalid
+func sendJSONOutput(ctx Ctx, output []byte) {
+	messages, err := jsonOutputMessages(ctx, output)
+	if err != nil {
+		log.Printf("JSON output of command %s: %s", ctx.messageCmd, err)
+		sendMessage(ctx.messageSignal, ctx.chatID, []byte("Error in JSON output of command: "+err.Error()), "")
+		return
+	}
+
+	go func() {
+		for _, message := range messages {
+			ctx.messageSignal <- message
+		}
+	}()
+}
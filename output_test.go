@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_jsonOutputMessages(t *testing.T) {
+	dir := t.TempDir()
+	photoPath := filepath.Join(dir, "graph.png")
+	if err := ioutil.WriteFile(photoPath, []byte("\x89PNG\x0D\x0A\x1A\x0A"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		chatID:    1,
+		commands:  Commands{"/restart": {shellCmd: "service $1 restart"}},
+		callbacks: NewCallbacks(),
+		appConfig: &Config{buttonTimeout: DefaultButtonTimeout},
+	}
+	keyboard := InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{{{Text: "Open", URL: "https://example.com"}}}}
+
+	data := []struct {
+		output   string
+		messages []BotMessage
+		err      string
+	}{
+		{
+			output:   `{"text": "hello"}`,
+			messages: []BotMessage{{chatID: 1, messageType: msgIsText, message: "hello"}},
+		},
+		{
+			output: `{"text": "<b>1</b>", "format": "html", "reply_to": 10, "silent": true, "buttons": [[{"text": "Open", "url": "https://example.com"}]]}`,
+			messages: []BotMessage{
+				{chatID: 1, messageType: msgIsText, message: "<b>1</b>", parseMode: "HTML", replyToID: 10, silent: true, replyMarkup: keyboard},
+			},
+		},
+		{
+			output: "{\"text\": \"one\"}\n{\"text\": \"two\"}\n",
+			messages: []BotMessage{
+				{chatID: 1, messageType: msgIsText, message: "one"},
+				{chatID: 1, messageType: msgIsText, message: "two"},
+			},
+		},
+		{
+			output: `[{"text": "one"}, {"photo": "` + photoPath + `", "text": "caption"}]`,
+			messages: []BotMessage{
+				{chatID: 1, messageType: msgIsText, message: "one"},
+				{chatID: 1, messageType: msgIsPhoto, fileName: "graph.png", fileData: []byte("\x89PNG\x0D\x0A\x1A\x0A"), caption: "caption"},
+			},
+		},
+		{
+			output: `{"document": "` + photoPath + `"}`,
+			messages: []BotMessage{
+				{chatID: 1, messageType: msgIsDocument, fileName: "graph.png", fileData: []byte("\x89PNG\x0D\x0A\x1A\x0A")},
+			},
+		},
+		{output: "", messages: nil},
+		{output: `{"text": "one"`, err: "reply #1: invalid JSON: unexpected EOF"},
+		{output: "{\"text\": \"one\"}\nnot json", err: "reply #2: invalid JSON: invalid character 'o' in literal null (expecting 'u')"},
+		{output: `[{"text": "one"}] []`, err: "invalid JSON: unexpected data after array"},
+		{output: `{"txt": "one"}`, err: `reply #1: invalid JSON: json: unknown field "txt"`},
+		{output: `{"silent": true}`, err: "reply #1: text, photo or document is required"},
+		{output: `{"text": "one", "format": "rtf"}`, err: "reply #1: unknown format: rtf"},
+		{output: `{"photo": "1.png", "document": "1.txt"}`, err: "reply #1: photo and document cannot be in one reply"},
+		{output: `{"photo": "` + photoPath + `", "text": "*1*", "format": "markdown"}`, err: "reply #1: format is supported only for text without photo or document"},
+		{output: `{"text": "one", "buttons": [[{"text": "Open", "url": "javascript:alert(1)"}]]}`, err: `reply #1: button "Open": url must be http(s):// or tg:// link: "javascript:alert(1)"`},
+		{output: `{"text": "one", "buttons": [[{"url": "https://example.com"}]]}`, err: "reply #1: text of button is required"},
+		{output: `{"text": "one", "buttons": [[{"text": "Run", "url": "https://example.com", "command": "/restart"}]]}`, err: `reply #1: button "Run": url and command cannot be in one button`},
+		{output: `{"text": "one", "buttons": [[{"text": "Run", "command": "/unknown"}]]}`, err: `reply #1: button "Run": command /unknown not found`},
+		{output: `{"text": "one"} {"document": "` + filepath.Join(dir, "not_exists") + `"}`, err: "reply #2: stat " + filepath.Join(dir, "not_exists")},
+		{output: `{"photo": "` + photoPath + `", "text": "` + strings.Repeat("x", MaxCaptionLength+1) + `"}`, err: "reply #1: caption is longer than 1024 characters"},
+	}
+
+	for _, item := range data {
+		messages, err := jsonOutputMessages(ctx, []byte(item.output))
+		if item.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), item.err) {
+				t.Errorf("Failing for %q\nexpected error: %q, real: %v", item.output, item.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(messages, item.messages) {
+			t.Errorf("Failing for %q\nexpected: %#v, real: %#v, %v", item.output, item.messages, messages, err)
+		}
+	}
+}
+
+func Test_jsonOutputCommandButtons(t *testing.T) {
+	ctx := Ctx{
+		chatID:    1,
+		commands:  Commands{"/restart": {shellCmd: "service $1 restart"}, "/logs": {shellCmd: "tail app.log"}},
+		callbacks: NewCallbacks(),
+		appConfig: &Config{buttonTimeout: DefaultButtonTimeout},
+	}
+
+	output := `{"text": "nginx failed", "buttons": [[{"text": "Restart", "command": "/restart", "args": "nginx"}, {"text": "Show logs", "command": "/logs"}]]}`
+	messages, err := jsonOutputMessages(ctx, []byte(output))
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("1. jsonOutputMessages() failed: %#v, %v", messages, err)
+	}
+
+	markup, ok := messages[0].replyMarkup.(InlineKeyboardMarkup)
+	if !ok || len(markup.InlineKeyboard) != 1 || len(markup.InlineKeyboard[0]) != 2 {
+		t.Fatalf("2. buttons failed: %#v", messages[0].replyMarkup)
+	}
+
+	expected := []callbackAction{{chatID: 1, command: "/restart", args: "nginx"}, {chatID: 1, command: "/logs"}}
+	for i, button := range markup.InlineKeyboard[0] {
+		id, kind := splitStringHalfBy(button.CallbackData, ":")
+		action, found := ctx.callbacks.Get(id)
+		action.expireAt = time.Time{}
+		if kind != "cmd" || !found || !reflect.DeepEqual(action, expected[i]) || len(button.CallbackData) > 64 {
+			t.Errorf("3. callback for button %q failed: %q, %#v", button.Text, button.CallbackData, action)
+		}
+	}
+}
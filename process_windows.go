@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup - process groups are not supported on Windows
+func setProcessGroup(_ *exec.Cmd) {}
+
+// killProcessGroup - kill shell process
+func killProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecondsForScheduleCheck - check schedules every 10 seconds, schedules are run once in a minute
+const SecondsForScheduleCheck = 10
+
+// Schedule - command which is run by cron expression, output is sent to chats
+type Schedule struct {
+	Name       string   `json:"name"`
+	Cron       string   `json:"cron"`        // cron expression: "0 9 * * 1-5", @hourly, @daily, ...
+	ShellCmd   string   `json:"shell"`       // shell command, only for schedules from config file
+	BotCmd     string   `json:"command"`     // bot command with arguments for schedules added from chat: "/uptime -p"
+	UserID     int      `json:"user_id"`     // user who added schedule from chat, bot command is checked for this user
+	Targets    []string `json:"targets"`     // chat IDs or users (@login or ID), for users output is sent to private chat
+	Paused     bool     `json:"paused"`      // schedule is paused by root
+	FromConfig bool     `json:"from_config"` // defined in config file, cannot be removed by root
+
+	command Command   // shell command with modificators
+	spec    cronSpec  // parsed cron expression
+	lastRun time.Time // minute of last run, for don't run twice in one minute
+}
+
+// checkScheduleTargets - check name and targets of schedule
+func checkScheduleTargets(name string, targets []string) error {
+	if !regexp.MustCompile(`^[\w-]+$`).MatchString(name) {
+		return fmt.Errorf("error: schedule name must contain only letters, digits, _ and -: %q", name)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("error: schedule %s must have chats or users for send output", name)
+	}
+	for _, target := range targets {
+		if cleanUserName(target) == "" {
+			return fmt.Errorf("error: schedule %s: chat or user cannot be empty", name)
+		}
+	}
+	return nil
+}
+
+// newSchedule - create schedule of shell command with parsed cron expression, only for schedules from config file
+func newSchedule(name, cronExpr string, targets []string, command Command) (schedule Schedule, err error) {
+	if err = checkScheduleTargets(name, targets); err != nil {
+		return schedule, err
+	}
+	if command.shellCmd == "" {
+		return schedule, fmt.Errorf("error: schedule %s: shell command cannot be empty", name)
+	}
+
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return schedule, err
+	}
+
+	return Schedule{
+		Name:     name,
+		Cron:     cronExpr,
+		ShellCmd: command.shellCmd,
+		Targets:  targets,
+		command:  command,
+		spec:     spec,
+	}, nil
+}
+
+// checkScheduleCommand - check shell command of schedule from config file in the same way as bot commands,
+// modificators which need message from user are not supported
+func checkScheduleCommand(name string, command Command, roles []string) error {
+	if command.stream || command.confirm || command.acceptFile {
+		return fmt.Errorf("error: :stream, :confirm and :accept_file cannot be used in schedule %s", name)
+	}
+
+	return checkCommands(Commands{"schedule " + name: command}, roles)
+}
+
+// newCommandSchedule - create schedule of bot command with arguments (added from chat),
+// command is found in bot commands on every run
+func newCommandSchedule(name, cronExpr string, targets []string, botCmd string, userID int) (schedule Schedule, err error) {
+	if err = checkScheduleTargets(name, targets); err != nil {
+		return schedule, err
+	}
+	if !strings.HasPrefix(botCmd, "/") {
+		return schedule, fmt.Errorf("error: schedule %s: bot command is required: /command [args]", name)
+	}
+
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return schedule, err
+	}
+
+	return Schedule{
+		Name:    name,
+		Cron:    cronExpr,
+		BotCmd:  botCmd,
+		UserID:  userID,
+		Targets: targets,
+		spec:    spec,
+	}, nil
+}
+
+// botCommand - get bot command and arguments of schedule added from chat, command is checked as if it was typed
+// by user who added schedule in every chat, chats where command is not allowed are skipped
+func (schedule Schedule) botCommand(ctx Ctx, chatIDs []int) (cmd Command, args string, allowedChatIDs []int, err error) {
+	cmdName, args := splitStringHalfBySpace(schedule.BotCmd)
+	cmd, found := ctx.commands[cmdName]
+	switch {
+	case !found:
+		return cmd, args, nil, fmt.Errorf("command %s not found", cmdName)
+	case schedule.UserID != 0 && !ctx.users.IsAuthorized(schedule.UserID):
+		return cmd, args, nil, fmt.Errorf("user %d, who added schedule, is not authorized", schedule.UserID)
+	}
+	if usageMsg := checkArgs(cmdName, cmd, args); usageMsg != "" {
+		return cmd, args, nil, fmt.Errorf("%s", usageMsg)
+	}
+
+	ctx.userID = schedule.UserID
+	for _, chatID := range chatIDs {
+		ctx.chatID = chatID
+		if isAllowedCommand(ctx, cmd) {
+			allowedChatIDs = append(allowedChatIDs, chatID)
+		} else {
+			log.Printf("schedule %s: command %s is not allowed in chat %d", schedule.Name, cmdName, chatID)
+		}
+	}
+
+	return cmd, args, allowedChatIDs, nil
+}
+
+// String - format schedule for list
+func (schedule Schedule) String() string {
+	command := schedule.ShellCmd
+	if schedule.BotCmd != "" {
+		command = schedule.BotCmd
+	}
+	result := fmt.Sprintf("%s: %s → %s: %s", schedule.Name, schedule.Cron, strings.Join(schedule.Targets, ","), command)
+	if schedule.Paused {
+		result += " (paused)"
+	}
+	if schedule.FromConfig {
+		result += " (config)"
+	}
+	return result
+}
+
+// SetConfigSchedules - set schedules from config file, paused state is kept from current schedules
+func (users *Users) SetConfigSchedules(schedules []Schedule) {
+	current := map[string]*Schedule{}
+	for name, schedule := range users.schedules {
+		current[name] = schedule
+		if schedule.FromConfig {
+			delete(users.schedules, name)
+		}
+	}
+
+	for _, schedule := range schedules {
+		schedule := schedule
+		if old, ok := current[schedule.Name]; ok {
+			schedule.Paused, schedule.lastRun = old.Paused, old.lastRun
+		}
+		schedule.FromConfig = true
+		users.schedules[schedule.Name] = &schedule
+	}
+	users.needSaveDB = true
+}
+
+// AddSchedule - add new schedule
+func (users *Users) AddSchedule(schedule Schedule) error {
+	if _, exists := users.schedules[schedule.Name]; exists {
+		return fmt.Errorf("schedule %s already exists", schedule.Name)
+	}
+
+	users.schedules[schedule.Name] = &schedule
+	users.needSaveDB = true
+	return nil
+}
+
+// RemoveSchedule - remove schedule, schedules from config file cannot be removed
+func (users *Users) RemoveSchedule(name string) error {
+	schedule, ok := users.schedules[name]
+	if !ok {
+		return fmt.Errorf("schedule %s not found", name)
+	}
+	if schedule.FromConfig {
+		return fmt.Errorf("schedule %s is defined in config file, it may be paused only", name)
+	}
+
+	delete(users.schedules, name)
+	users.needSaveDB = true
+	return nil
+}
+
+// PauseSchedule - pause or resume schedule
+func (users *Users) PauseSchedule(name string, paused bool) error {
+	schedule, ok := users.schedules[name]
+	if !ok {
+		return fmt.Errorf("schedule %s not found", name)
+	}
+
+	schedule.Paused = paused
+	users.needSaveDB = true
+	return nil
+}
+
+// Schedules - get all schedules sorted by name
+func (users Users) Schedules() []Schedule {
+	result := []Schedule{}
+	for _, schedule := range users.schedules {
+		result = append(result, *schedule)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// DueSchedules - get schedules which must be run now, every schedule is returned once in a minute
+func (users *Users) DueSchedules(now time.Time) []Schedule {
+	minute := now.Truncate(time.Minute)
+	result := []Schedule{}
+	for _, schedule := range users.schedules {
+		if !schedule.Paused && !schedule.lastRun.Equal(minute) && schedule.spec.match(now) {
+			schedule.lastRun = minute
+			result = append(result, *schedule)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// ScheduleChatIDs - get chats for send output of schedule, users are resolved to their private chats
+func (users Users) ScheduleChatIDs(schedule Schedule) []int {
+	result := []int{}
+	for _, target := range schedule.Targets {
+		if chatID, err := strconv.Atoi(target); err == nil {
+			result = append(result, chatID)
+			continue
+		}
+
+		if user, ok := users.list[users.FindByIDOrUserName(target)]; ok && user.PrivateChatID > 0 {
+			result = append(result, user.PrivateChatID)
+		} else {
+			log.Printf("schedule %s: private chat with user %s not found", schedule.Name, target)
+		}
+	}
+
+	return result
+}
+
+// runSchedule - run command of schedule and send output to chats
+func runSchedule(ctx Ctx, schedule Schedule, chatIDs []int) {
+	cmd, input := schedule.command, ""
+	if schedule.BotCmd != "" {
+		var err error
+		if cmd, input, chatIDs, err = schedule.botCommand(ctx, chatIDs); err != nil {
+			log.Printf("schedule %s: %s", schedule.Name, err)
+			ctx.users.BroadcastForRoots(ctx.messageSignal, fmt.Sprintf("schedule %s failed: %s", schedule.Name, err), 0)
+			return
+		}
+		if len(chatIDs) == 0 {
+			return
+		}
+	}
+
+	rootChatIDs := []int{}
+	if cmd.onError == onErrorRoots {
+		rootChatIDs = ctx.users.RootChatIDs(0)
+	}
+	if cmd.outputJSON {
+		// commands are checked for buttons in goroutine, but may be changed in main loop
+		ctx.commands = ctx.commands.copy()
+	}
+
+	go func() {
+		output, status := runJob(ctx, Job{command: "schedule", args: schedule.Name}, cmd, input, nil, nil, ShellUser{})
+
+		if status.err == nil && cmd.onError != "" {
+			return
+		}
+		if status.err != nil && cmd.onError == onErrorRoots {
+			for _, chatID := range rootChatIDs {
+				sendMessage(ctx.messageSignal, chatID, []byte(fmt.Sprintf("schedule %s failed: %s", schedule.Name, status)), "")
+			}
+		}
+		for _, chatID := range chatIDs {
+			chatCtx := ctx
+			chatCtx.chatID = chatID
+			sendCommandResult(chatCtx, cmd, output, status)
+		}
+	}()
+}
+
+// /shell2telegram schedule list|add|rm|pause|resume
+func cmdShell2telegramSchedule(ctx Ctx) (replayMsg string) {
+	usage := "Usage: /shell2telegram schedule list\n" +
+		"/shell2telegram schedule add <name> <cron> <chat_id|@username,...> </command> [args]\n" +
+		"/shell2telegram schedule rm|pause|resume <name>"
+
+	action, args := splitStringHalfBySpace(ctx.messageArgs)
+	var err error
+	switch action {
+	case "list":
+		schedules := ctx.users.Schedules()
+		if len(schedules) == 0 {
+			return "No schedules"
+		}
+		schedulesMsg := []string{}
+		for _, schedule := range schedules {
+			schedulesMsg = append(schedulesMsg, schedule.String())
+		}
+		return strings.Join(schedulesMsg, "\n")
+
+	case "add":
+		// name, 5 fields of cron expression (or one @alias), targets, bot command with arguments
+		parts := regexp.MustCompile(`\s+`).Split(args, 8)
+		cronFields := 5
+		if len(parts) > 1 && strings.HasPrefix(parts[1], "@") {
+			cronFields = 1
+			parts = regexp.MustCompile(`\s+`).Split(args, 4)
+		}
+		if len(parts) != cronFields+3 {
+			return usage
+		}
+
+		name, cronExpr := parts[0], strings.Join(parts[1:cronFields+1], " ")
+		targets, botCmd := strings.Split(parts[cronFields+1], ","), parts[cronFields+2]
+		var schedule Schedule
+		if schedule, err = newCommandSchedule(name, cronExpr, targets, botCmd, ctx.userID); err == nil {
+			if _, _, _, err = schedule.botCommand(ctx, nil); err == nil {
+				err = ctx.users.AddSchedule(schedule)
+			}
+		}
+		if err == nil {
+			return "Schedule added: " + schedule.String()
+		}
+
+	case "rm":
+		if err = ctx.users.RemoveSchedule(args); err == nil {
+			return "Schedule removed"
+		}
+
+	case "pause", "resume":
+		if err = ctx.users.PauseSchedule(args, action == "pause"); err == nil {
+			return fmt.Sprintf("Schedule %s: %s", args, action+"d")
+		}
+
+	default:
+		return usage
+	}
+
+	return err.Error()
+}
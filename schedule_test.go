@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msoap/raphanus"
+)
+
+func Test_cmdShell2telegramSchedule(t *testing.T) {
+	users := Users{
+		list: map[int]*User{
+			1: {UserID: 1, UserName: "root_user", IsAuthorized: true, IsRoot: true, PrivateChatID: 1},
+		},
+		schedules: map[string]*Schedule{},
+	}
+	configSchedule, _ := newSchedule("config", "@daily", []string{"1"}, Command{shellCmd: "date"})
+	users.SetConfigSchedules([]Schedule{configSchedule})
+	_, dfCommand, _ := parseBotCommand("/df:vars=DIR:re=DIR=^/[a-z/]*$", "df -h $DIR")
+	ctx := Ctx{users: &users, userID: 1, commands: Commands{"/df": dfCommand, "/uptime": {shellCmd: "uptime"}}}
+
+	data := []struct {
+		args, result string
+	}{
+		{"add disk 0 9 * * 1-5 -100123,@root_user /df /", "Schedule added: disk: 0 9 * * 1-5 → -100123,@root_user: /df /"},
+		{"add disk @daily 1 /df /", "schedule disk already exists"},
+		{"add uptime @hourly root_user /uptime", "Schedule added: uptime: @hourly → root_user: /uptime"},
+		{"add bad 0 25 * * * 1 /uptime", `error: cron expression "0 25 * * *": value out of range 0-23: 25`},
+		{"add shell @daily 1 rm -rf /", "error: schedule shell: bot command is required: /command [args]"},
+		{"add unknown @daily 1 /unknown", "command /unknown not found"},
+		{"add bad_args @daily 1 /df ../etc", "Usage: /df DIR"},
+		{"add short @daily", "Usage: /shell2telegram schedule list"},
+		{"pause disk", "Schedule disk: paused"},
+		{"rm config", "schedule config is defined in config file, it may be paused only"},
+		{"rm uptime", "Schedule removed"},
+		{"rm uptime", "schedule uptime not found"},
+		{"list", "config: @daily → 1: date (config)\ndisk: 0 9 * * 1-5 → -100123,@root_user: /df / (paused)"},
+		{"resume disk", "Schedule disk: resumed"},
+	}
+
+	for _, item := range data {
+		ctx.messageArgs = item.args
+		if result := cmdShell2telegramSchedule(ctx); !strings.HasPrefix(result, item.result) {
+			t.Errorf("Failing for %q\nexpected: %q, real: %q", item.args, item.result, result)
+		}
+	}
+
+	now, _ := time.Parse("2006-01-02 15:04:05", "2024-01-15 09:00:10")
+	if due := users.DueSchedules(now); len(due) != 1 || due[0].Name != "disk" {
+		t.Errorf("DueSchedules failed: %#v", due)
+	}
+	if due := users.DueSchedules(now.Add(20 * time.Second)); len(due) != 0 {
+		t.Errorf("DueSchedules must return schedule once in a minute: %#v", due)
+	}
+	if chatIDs := users.ScheduleChatIDs(*users.schedules["disk"]); !reflect.DeepEqual(chatIDs, []int{-100123, 1}) {
+		t.Errorf("ScheduleChatIDs failed: %#v", chatIDs)
+	}
+
+	// schedules from config are replaced on reload, paused state is kept
+	if err := users.PauseSchedule("config", true); err != nil {
+		t.Fatal(err)
+	}
+	users.SetConfigSchedules([]Schedule{configSchedule})
+	if !users.schedules["config"].Paused || len(users.schedules) != 2 {
+		t.Errorf("SetConfigSchedules failed: %#v", users.Schedules())
+	}
+	users.SetConfigSchedules(nil)
+	if _, ok := users.schedules["config"]; ok || len(users.schedules) != 1 {
+		t.Errorf("SetConfigSchedules must remove schedules from config: %#v", users.Schedules())
+	}
+}
+
+func Test_SchedulesSaveToDB(t *testing.T) {
+	dbFile := writeTestConfig(t, "users.json", "")
+	users := NewUsers(Config{})
+	schedule, _ := newCommandSchedule("disk", "@daily", []string{"user1"}, "/df /home", 1)
+	if err := users.AddSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.PauseSchedule("disk", true); err != nil {
+		t.Fatal(err)
+	}
+	// shell commands are not loaded from DB, only from config file
+	shellSchedule, _ := newSchedule("shell", "@daily", []string{"user1"}, Command{shellCmd: "df -h"})
+	if err := users.AddSchedule(shellSchedule); err != nil {
+		t.Fatal(err)
+	}
+	users.SaveToDB(dbFile)
+
+	loaded := NewUsers(Config{persistentUsers: true, usersDB: dbFile})
+	schedules := loaded.Schedules()
+	if len(schedules) != 1 || schedules[0].String() != "disk: @daily → user1: /df /home (paused)" || schedules[0].UserID != 1 || !schedules[0].spec.match(time.Time{}) {
+		t.Errorf("load schedules from DB failed: %#v", schedules)
+	}
+}
+
+func Test_runScheduleBotCommand(t *testing.T) {
+	users := Users{list: map[int]*User{
+		1: {UserID: 1, UserName: "root_user", IsAuthorized: true, IsRoot: true, PrivateChatID: 1},
+		2: {UserID: 2, UserName: "user2", IsAuthorized: true},
+		3: {UserID: 3, UserName: "user3"},
+	}}
+	messageSignal := make(chan BotMessage, MessagesQueueSize)
+	cache := raphanus.New()
+	_, echoCommand, _ := parseBotCommand("/echo:vars=MSG", "echo $MSG")
+	ctx := Ctx{
+		appConfig: &Config{shell: "sh"},
+		users:     &users,
+		commands: Commands{
+			"/echo":   echoCommand,
+			"/secret": {shellCmd: "echo secret", allowChats: []int{-100}},
+			"/reboot": {shellCmd: "echo reboot", rootOnly: true},
+		},
+		messageSignal:  messageSignal,
+		cache:          &cache,
+		oneThreadMutex: &sync.Mutex{},
+		jobs:           NewJobs(),
+	}
+
+	data := []struct {
+		botCmd   string
+		userID   int
+		chatIDs  []int
+		messages []string
+	}{
+		{"/echo hello", 1, []int{-100, -200}, []string{"-100: hello\n", "-200: hello\n"}},
+		{"/secret", 1, []int{-100, -200}, []string{"-100: secret\n"}},
+		{"/reboot", 2, []int{-100}, nil},
+		{"/reboot", 1, []int{-100}, []string{"-100: reboot\n"}},
+		{"/missing", 1, []int{-100}, []string{"1: schedule test failed: command /missing not found"}},
+		{"/echo hello", 3, []int{-100}, []string{"1: schedule test failed: user 3, who added schedule, is not authorized"}},
+	}
+
+	for i, item := range data {
+		schedule, err := newCommandSchedule("test", "@daily", []string{"1"}, item.botCmd, item.userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runSchedule(ctx, schedule, item.chatIDs)
+
+		messages := []string{}
+		for len(messages) < len(item.messages) {
+			select {
+			case message := <-messageSignal:
+				messages = append(messages, fmt.Sprintf("%d: %s", message.chatID, message.message))
+			case <-time.After(3 * time.Second):
+				t.Fatalf("%d. runSchedule() for %s: wait messages, got: %#v", i+1, item.botCmd, messages)
+			}
+		}
+		sort.Strings(messages)
+		if len(item.messages) > 0 && !reflect.DeepEqual(messages, item.messages) {
+			t.Errorf("%d. runSchedule() for %s failed: %#v, expected: %#v", i+1, item.botCmd, messages, item.messages)
+		}
+	}
+
+	select {
+	case message := <-messageSignal:
+		t.Errorf("unexpected message: %#v", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -3,17 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
-	"time"
-
-	"github.com/msoap/raphanus"
-	tgbotapi "gopkg.in/telegram-bot-api.v2"
+	"syscall"
 )
 
 const (
@@ -29,22 +27,86 @@ const (
 	// MaxMessageLength - max length of one bot message
 	MaxMessageLength = 4096
 
+	// MaxCaptionLength - max length of caption for document
+	MaxCaptionLength = 1024
+
+	// DefaultDocumentName - file name for command output sent as document
+	DefaultDocumentName = "output.txt"
+
 	// SecondsForAutoSaveUsersToDB - save users to file every 1 min (if need)
 	SecondsForAutoSaveUsersToDB = 60
 
+	// DefaultConfirmTimeout - timeout for press "Run" button for commands with :confirm
+	DefaultConfirmTimeout = 60
+	// DefaultButtonTimeout - timeout for press buttons from JSON output of commands (one day)
+	DefaultButtonTimeout = 24 * 60 * 60
+
+	// DefaultMaxFileSize - max size of file from user (20 MB is limit of Telegram Bot API for download)
+	DefaultMaxFileSize = 20 * 1024 * 1024
+
+	// StreamEditInterval - interval between edits of message with output of command with :stream (in seconds)
+	StreamEditInterval = 3
+
 	// DBFileName - DB json name
 	DBFileName = "shell2telegram.json"
 
+	// DefaultEnvAllow - environment variables inherited by shell commands in clean environment mode
+	DefaultEnvAllow = "PATH,HOME,USER,SHELL,LANG,LC_ALL,TZ,TMPDIR"
+
+	// onErrorOnly - send output of command only if command failed (/cmd:on_error=only)
+	onErrorOnly = "only"
+
+	// onErrorRoots - same as onErrorOnly and send notification to root users (/cmd:on_error=roots)
+	onErrorRoots = "roots"
+
 	// shell2telegram command name for get plain text without /command
 	cmdPlainText = "/:plain_text"
+
+	// shell2telegram command name for get image from user
+	cmdImage = "/:image"
+
+	// shell2telegram command name for get file from user
+	cmdDocument = "/:document"
+
+	// shell2telegram command name for get voice message from user
+	cmdVoice = "/:voice"
+
+	// shell2telegram command name for get location from user
+	cmdLocation = "/:location"
+
+	// shell2telegram command name for get contact from user
+	cmdContact = "/:contact"
+
+	// shell2telegram command name for inline queries (@bot query)
+	cmdInline = "/:inline"
 )
 
 // Command - one user command
 type Command struct {
-	shellCmd    string   // shell command
-	description string   // command description for list in /help (/cmd:desc="Command name")
-	vars        []string // environment vars for user text, split by `/s+` to vars (/cmd:vars=SUBCOMMAND,ARGS)
-	isMarkdown  bool     // send message in markdown format
+	shellCmd    string              // shell command
+	description string              // command description for list in /help (/cmd:desc="Command name")
+	vars        []string            // environment vars for user text, split by `/s+` to vars (/cmd:vars=SUBCOMMAND,ARGS)
+	isMarkdown  bool                // send message in markdown format
+	format      string              // format of output: markdown, markdownv2, html or pre (/cmd:format=pre)
+	timeout     int                 // timeout for execute shell command in seconds (/cmd:timeout=30), 0 - from -sh-timeout, -1 - without timeout
+	cache       int                 // caching command out in seconds (/cmd:cache=300), 0 - from -cache, -1 - without caching
+	shell       string              // custom shell for command (/cmd:shell=bash), "" - from -shell
+	cwd         string              // working directory for command (/cmd:cwd=/srv/app)
+	env         map[string]string   // environment variables for command (/cmd:env=FOO=bar:env=BAR=baz)
+	rootOnly    bool                // command allowed only for root users (/cmd:root)
+	allowUsers  []string            // users (@login or ID) allowed to run command (/cmd:users=user1,12345)
+	allowChats  []int               // chats allowed to run command in (/cmd:chats=-100123,456)
+	allowRoles  []string            // roles of users allowed to run command (/cmd:roles=ops,deploy)
+	argChecks   map[string]argCheck // validation of arguments by var name (/cmd:vars=SLEEP:int=SLEEP=1,3600)
+	confirm     bool                // ask confirmation with inline buttons before run (/cmd:confirm)
+	acceptFile  bool                // get file from message with caption "/cmd args" (/cmd:accept_file)
+	asDocument  bool                // send output as document (/cmd:as_document or /cmd:as_document=report.txt)
+	docName     string              // file name of document, "" - DefaultDocumentName
+	stream      bool                // send output while command runs by editing of message (/cmd:stream)
+	withStderr  bool                // send STDERR of command with output (/cmd:stderr)
+	showStatus  bool                // add footer with exit code and duration to output (/cmd:status)
+	onError     string              // send output only if command failed: only, roots - and notify root users (/cmd:on_error=only)
+	outputJSON  bool                // output is JSON with replies: text, photo, document, buttons (/cmd:output=json)
 }
 
 // Commands - list of all commands
@@ -52,353 +114,315 @@ type Commands map[string]Command
 
 // Config - config struct
 type Config struct {
-	token                  string   // bot token
-	botTimeout             int      // bot timeout
-	predefinedAllowedUsers []string // telegram users who are allowed to chat with the bot
-	predefinedRootUsers    []string // telegram users, who confirms new users in their private chat
-	description            string   // description of bot
-	bindAddr               string   // bind address to listen webhook requests
-	webhookURL             url.URL  // url for the webhook
-	usersDB                string   // file for store users
-	shell                  string   // custom shell
-	cache                  int      // caching command out (in seconds)
-	shTimeout              int      // timeout for execute shell command (in seconds)
-	addExit                bool     // adding /shell2telegram exit command
-	allowAll               bool     // allow all user (DANGEROUS!)
-	logCommands            bool     // logging all commands
-	persistentUsers        bool     // load/save users from file
-	isPublicBot            bool     // bot is public (don't add /auth* commands)
-	oneThread              bool     // run each shell commands in one thread
+	configFile             string     // config file with options and commands
+	token                  string     // bot token
+	botTimeout             int        // bot timeout
+	predefinedAllowedUsers []string   // telegram users who are allowed to chat with the bot
+	predefinedRootUsers    []string   // telegram users, who confirms new users in their private chat
+	roles                  []string   // names of roles which may be assigned to users
+	description            string     // description of bot
+	bindAddr               string     // bind address to listen webhook requests
+	webhookURL             url.URL    // url for the webhook
+	usersDB                string     // file for store users
+	shell                  string     // custom shell
+	cache                  int        // caching command out (in seconds)
+	shTimeout              int        // timeout for execute shell command (in seconds)
+	addExit                bool       // adding /shell2telegram exit command
+	allowAll               bool       // allow all user (DANGEROUS!)
+	logCommands            bool       // logging all commands
+	persistentUsers        bool       // load/save users from file
+	isPublicBot            bool       // bot is public (don't add /auth* commands)
+	oneThread              bool       // run each shell commands in one thread
+	cleanEnv               bool       // run shell commands with clean environment
+	envAllow               []string   // environment variables inherited from bot in clean environment mode
+	confirmTimeout         int        // timeout for confirm command (in seconds)
+	buttonTimeout          int        // timeout for press buttons from JSON output of commands (in seconds)
+	maxFileSize            int        // max size of file from user (in bytes)
+	documentSize           int        // send output larger than this as document (in bytes), 0 - never
+	documentPreview        int        // count of first lines of output for caption of document
+	logFile                string     // log file name, default - STDOUT
+	schedules              []Schedule // scheduled commands from config file
+	apiToken               string     // token for HTTP API
+	ctlSocket              string     // unix socket for shell2telegram ctl
+	noMenu                 bool       // don't publish commands to bot menu
 }
 
 // message types
 const (
 	msgIsText int8 = iota
 	msgIsPhoto
+	msgIsDocument
+	msgIsVideo
+	msgIsAnimation
+	msgIsAudio
+	msgIsEdit           // edit text of sent message
+	msgIsCallbackAnswer // answer to callback query from inline keyboard
+	msgIsInlineAnswer   // answer to inline query with results
 )
 
 // BotMessage - record for send via channel for send message to telegram chat
 type BotMessage struct {
-	message     string
-	fileName    string
-	photo       []byte
-	chatID      int
-	messageType int8
-	isMarkdown  bool
+	message         string
+	fileName        string
+	fileData        []byte // content of photo or document
+	caption         string // caption of document
+	chatID          int
+	messageType     int8
+	parseMode       string      // parse mode of text message: Markdown, MarkdownV2, HTML
+	messageID       int         // message for edit
+	callbackQueryID string      // callback query for answer
+	replyMarkup     interface{} // inline keyboard
+	sentID          chan<- int  // for get ID of sent text message, 0 if sending failed
+	replyToID       int         // send as reply to message
+	silent          bool        // send without notification
+	inlineQueryID   string      // inline query for answer
+	inlineResults   []InlineQueryResultArticle
+	cacheTime       int // cache time of inline results in seconds
 }
 
 // ----------------------------------------------------------------------------
+// newFlagSet - create set of command-line options bound to appConfig fields
+func newFlagSet(appConfig *Config, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(os.Args[0], errorHandling)
+	flagSet.StringVar(&appConfig.configFile, "config", "", "config `file` with options and commands (YAML or JSON)")
+	flagSet.StringVar(&appConfig.token, "tb-token", "", "setting bot `token` (or set TB_TOKEN variable)")
+	flagSet.BoolVar(&appConfig.addExit, "add-exit", false, "adding \"/shell2telegram exit\" command for terminate bot (for roots only)")
+	flagSet.IntVar(&appConfig.botTimeout, "timeout", DefaultBotTimeout, "setting timeout for bot (in `seconds`)")
+	flagSet.StringVar(&appConfig.bindAddr, "bind-addr", "", "bind address to listen webhook requests, like: `0.0.0.0:8080`")
+	flagSet.Var(&urlValue{&appConfig.webhookURL}, "webhook", "`url` of bot's webhook")
+	flagSet.StringVar(&appConfig.apiToken, "api-token", "", "`token` for HTTP API "+apiSendPath+" on -bind-addr (or set S2T_API_TOKEN variable)")
+	flagSet.StringVar(&appConfig.ctlSocket, "ctl-socket", "", "unix socket `file` for administer bot with \"shell2telegram ctl\"")
+	flagSet.BoolVar(&appConfig.allowAll, "allow-all", false, "allow all users (DANGEROUS!)")
+	flagSet.BoolVar(&appConfig.logCommands, "log-commands", false, "logging all commands")
+	flagSet.StringVar(&appConfig.description, "description", "", "setting description of bot")
+	flagSet.BoolVar(&appConfig.persistentUsers, "persistent-users", false, "load/save users from file (default ~/.config/shell2telegram.json)")
+	flagSet.StringVar(&appConfig.usersDB, "users-db", "", "`file` for store users")
+	flagSet.IntVar(&appConfig.cache, "cache", 0, "caching command out (in `seconds`), default for all commands")
+	flagSet.BoolVar(&appConfig.isPublicBot, "public", false, "bot is public (don't add /auth* commands)")
+	flagSet.BoolVar(&appConfig.noMenu, "no-menu", false, "don't publish commands to bot menu")
+	flagSet.IntVar(&appConfig.shTimeout, "sh-timeout", 0, "set timeout for execute shell command (in `seconds`), default for all commands")
+	flagSet.StringVar(&appConfig.shell, "shell", "sh", "custom shell or \"\" for execute without shell, default for all commands")
+	flagSet.BoolVar(&appConfig.oneThread, "one-thread", false, "run each shell command in one thread")
+	flagSet.BoolVar(&appConfig.cleanEnv, "clean-env", false, "run shell commands with clean environment, only variables from -env-allow are inherited")
+	appConfig.envAllow = strings.Split(DefaultEnvAllow, ",")
+	flagSet.Var(&stringListValue{&appConfig.envAllow}, "env-allow", "environment variables inherited from bot with -clean-env (\"VAR1,VAR2\")")
+	flagSet.IntVar(&appConfig.confirmTimeout, "confirm-timeout", DefaultConfirmTimeout, "timeout for confirm commands with :confirm (in `seconds`)")
+	flagSet.IntVar(&appConfig.buttonTimeout, "button-timeout", DefaultButtonTimeout, "timeout for press buttons from JSON output of commands (in `seconds`)")
+	flagSet.IntVar(&appConfig.maxFileSize, "max-file-size", DefaultMaxFileSize, "max size of file from user (in `bytes`), 0 - without limit")
+	flagSet.IntVar(&appConfig.documentSize, "document-size", 0, "send output larger than this as document (in `bytes`), 0 - split to messages")
+	flagSet.IntVar(&appConfig.documentPreview, "document-preview", 0, "add first `lines` of output as caption of document")
+	flagSet.StringVar(&appConfig.logFile, "log", "", "log `filename`, default - STDOUT")
+	flagSet.Var(&stringListValue{&appConfig.predefinedAllowedUsers}, "allow-users", "telegram users who are allowed to chat with the bot (\"user1,user2\")")
+	flagSet.Var(&stringListValue{&appConfig.predefinedRootUsers}, "root-users", "telegram users, who confirms new users in their private chat (\"user1,user2\")")
+	flagSet.Var(&stringListValue{&appConfig.roles}, "roles", "names of roles, which may be assigned to users by root (\"ops,viewer\")")
+
+	return flagSet
+}
+
 // get config
 func getConfig() (commands Commands, appConfig Config, err error) {
-	flag.StringVar(&appConfig.token, "tb-token", "", "setting bot `token` (or set TB_TOKEN variable)")
-	flag.BoolVar(&appConfig.addExit, "add-exit", false, "adding \"/shell2telegram exit\" command for terminate bot (for roots only)")
-	flag.IntVar(&appConfig.botTimeout, "timeout", DefaultBotTimeout, "setting timeout for bot (in `seconds`)")
-	flag.StringVar(&appConfig.bindAddr, "bind-addr", "", "bind address to listen webhook requests, like: `0.0.0.0:8080`")
-	flag.Var(&urlValue{&appConfig.webhookURL}, "webhook", "`url` of bot's webhook")
-	flag.BoolVar(&appConfig.allowAll, "allow-all", false, "allow all users (DANGEROUS!)")
-	flag.BoolVar(&appConfig.logCommands, "log-commands", false, "logging all commands")
-	flag.StringVar(&appConfig.description, "description", "", "setting description of bot")
-	flag.BoolVar(&appConfig.persistentUsers, "persistent-users", false, "load/save users from file (default ~/.config/shell2telegram.json)")
-	flag.StringVar(&appConfig.usersDB, "users-db", "", "`file` for store users")
-	flag.IntVar(&appConfig.cache, "cache", 0, "caching command out (in `seconds`)")
-	flag.BoolVar(&appConfig.isPublicBot, "public", false, "bot is public (don't add /auth* commands)")
-	flag.IntVar(&appConfig.shTimeout, "sh-timeout", 0, "set timeout for execute shell command (in `seconds`)")
-	flag.StringVar(&appConfig.shell, "shell", "sh", "custom shell or \"\" for execute without shell")
-	flag.BoolVar(&appConfig.oneThread, "one-thread", false, "run each shell command in one thread")
-	logFilename := flag.String("log", "", "log `filename`, default - STDOUT")
-	predefinedAllowedUsers := flag.String("allow-users", "", "telegram users who are allowed to chat with the bot (\"user1,user2\")")
-	predefinedRootUsers := flag.String("root-users", "", "telegram users, who confirms new users in their private chat (\"user1,user2\")")
-	showVersion := flag.Bool("version", false, "get version")
-
-	flag.Usage = func() {
-		fmt.Printf("usage: %s [options] %s\n%s\n%s\n\noptions:\n",
+	flagSet := newFlagSet(&appConfig, flag.ExitOnError)
+	showVersion := flagSet.Bool("version", false, "get version")
+
+	flagSet.Usage = func() {
+		fmt.Printf("usage: %s [options] %s\n%s\n%s\n%s\n%s\n\noptions:\n",
 			os.Args[0],
 			`/chat_command "shell command" /chat_command2 "shell command2"`,
 			"All text after /chat_command will be sent to STDIN of shell command.",
 			"If chat command is /:plain_text - get user message without any /command (for private chats only)",
+			"Options and commands may be defined in -config file, command-line options override it.",
+			"Administer running bot: "+os.Args[0]+" ctl [-ctl-socket=file] sub-command [args]",
 		)
-		flag.PrintDefaults()
+		flagSet.PrintDefaults()
 		os.Exit(0)
 	}
-	flag.Parse()
+	_ = flagSet.Parse(os.Args[1:]) // exit on error
 
 	if *showVersion {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
+	commands, err = loadConfig(flagSet, &appConfig)
+	if err != nil {
+		return commands, appConfig, err
+	}
+
 	// setup log file
-	if len(*logFilename) > 0 {
-		fhLog, err := os.OpenFile(*logFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if len(appConfig.logFile) > 0 {
+		fhLog, err := os.OpenFile(appConfig.logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
 			log.Fatalf("error opening log file: %v", err)
 		}
 		log.SetOutput(fhLog)
 	}
 
-	// setup users and roots
-	if *predefinedAllowedUsers != "" {
-		appConfig.predefinedAllowedUsers = strings.Split(*predefinedAllowedUsers, ",")
+	return commands, appConfig, nil
+}
+
+// reloadConfig - re-read config file and command-line options,
+// options which need restart of bot (token, webhook, users DB, log) are kept from current config
+func reloadConfig(current Config) (commands Commands, appConfig Config, err error) {
+	flagSet := newFlagSet(&appConfig, flag.ContinueOnError)
+	flagSet.SetOutput(ioutil.Discard)
+	if err = flagSet.Parse(os.Args[1:]); err != nil {
+		return commands, appConfig, err
 	}
-	if *predefinedRootUsers != "" {
-		appConfig.predefinedRootUsers = strings.Split(*predefinedRootUsers, ",")
+
+	if commands, err = loadConfig(flagSet, &appConfig); err != nil {
+		return commands, appConfig, err
 	}
 
+	appConfig.token = current.token
+	appConfig.botTimeout = current.botTimeout
+	appConfig.bindAddr = current.bindAddr
+	appConfig.webhookURL = current.webhookURL
+	appConfig.usersDB = current.usersDB
+	appConfig.persistentUsers = current.persistentUsers
+	appConfig.logFile = current.logFile
+	appConfig.apiToken = current.apiToken
+	appConfig.ctlSocket = current.ctlSocket
+
+	return commands, appConfig, nil
+}
+
+// loadConfig - read config file and commands from command-line (they override commands from file)
+func loadConfig(flagSet *flag.FlagSet, appConfig *Config) (commands Commands, err error) {
 	commands = Commands{}
-	// need >= 2 arguments and count of it must be even
-	args := flag.Args()
-	if len(args) < 2 || len(args)%2 == 1 {
-		return commands, appConfig, fmt.Errorf("error: need pairs of /chat-command and shell-command")
+	if appConfig.configFile != "" {
+		if commands, appConfig.schedules, err = loadConfigFile(appConfig.configFile, flagSet); err != nil {
+			return commands, err
+		}
+	}
+
+	// need pairs of arguments (or commands from config file)
+	args := flagSet.Args()
+	if len(args)%2 == 1 || len(args) == 0 && len(commands) == 0 {
+		return commands, fmt.Errorf("error: need pairs of /chat-command and shell-command")
 	}
 
 	for i := 0; i < len(args); i += 2 {
 		path, command, err := parseBotCommand(args[i], args[i+1]) // (/path, shell_command)
 		if err != nil {
-			return commands, appConfig, err
+			return commands, err
 		}
 		commands[path] = command
 	}
 
+	if err = checkCommands(commands, appConfig.roles); err != nil {
+		return commands, err
+	}
+
+	if appConfig.apiToken == "" {
+		appConfig.apiToken = os.Getenv("S2T_API_TOKEN")
+	}
+
 	if appConfig.token == "" {
 		if appConfig.token = os.Getenv("TB_TOKEN"); appConfig.token == "" {
-			return commands, appConfig, fmt.Errorf("TB_TOKEN environment var not found. See https://core.telegram.org/bots#botfather for more information")
+			return commands, fmt.Errorf("TB_TOKEN environment var not found. See https://core.telegram.org/bots#botfather for more information")
 		}
 	}
 
-	return commands, appConfig, nil
+	return commands, nil
 }
 
 // ----------------------------------------------------------------------------
-func sendMessage(messageSignal chan<- BotMessage, chatID int, message []byte, isMarkdown bool) {
+func sendMessage(messageSignal chan<- BotMessage, chatID int, message []byte, format string) {
 	go func() {
-		var fileName string
-		fileType := http.DetectContentType(message)
-		switch fileType {
-		case "image/png":
-			fileName = "file.png"
-		case "image/jpeg":
-			fileName = "file.jpeg"
-		case "image/gif":
-			fileName = "file.gif"
-		case "image/bmp":
-			fileName = "file.bmp"
-		case "video/mp4":
-			// TODO: nedded migrate to new telegram-bot-api library
-			log.Printf("not supported")
-			return
-		default:
-			fileName = "message"
-		}
+		messageType, fileName := detectOutputFile(message)
 
-		if fileName == "message" {
+		if messageType == msgIsText {
 			// is text message
-			messageString := string(message)
-			var messagesList []string
-
-			if len(messageString) <= MaxMessageLength {
-				messagesList = []string{messageString}
-			} else {
-				messagesList = splitStringLinesBySize(messageString, MaxMessageLength)
-			}
+			messagesList, parseMode := formatMessages(string(message), format)
 
 			for _, messageChunk := range messagesList {
 				messageSignal <- BotMessage{
 					chatID:      chatID,
 					messageType: msgIsText,
 					message:     messageChunk,
-					isMarkdown:  isMarkdown,
+					parseMode:   parseMode,
 				}
 			}
 
 		} else {
-			// is image
+			// is image, video, audio, ...
 			messageSignal <- BotMessage{
 				chatID:      chatID,
-				messageType: msgIsPhoto,
+				messageType: messageType,
 				fileName:    fileName,
-				photo:       message,
+				fileData:    message,
 			}
 		}
 	}()
 }
 
+// sendDocument - send command output as text file
+func sendDocument(messageSignal chan<- BotMessage, chatID int, fileName string, data []byte, caption string) {
+	go func() {
+		messageSignal <- BotMessage{
+			chatID:      chatID,
+			messageType: msgIsDocument,
+			fileName:    fileName,
+			fileData:    data,
+			caption:     caption,
+		}
+	}()
+}
+
 // ----------------------------------------------------------------------------
 func main() {
-	commands, appConfig, err := getConfig()
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		if err := runCtl(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	commands, config, err := getConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	appConfig := &config
 
-	bot, err := tgbotapi.NewBotAPI(appConfig.token)
+	transport, err := newTelegramTransport(appConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("Authorized on bot account: @%s", bot.Self.UserName)
+	bot := NewBot(transport, commands, appConfig)
 
-	tgbotConfig := tgbotapi.NewUpdate(0)
-	tgbotConfig.Timeout = appConfig.botTimeout
-	var botUpdatesChan <-chan tgbotapi.Update
 	var server *http.Server
-
 	if appConfig.bindAddr != "" {
-		_, err = bot.SetWebhook(tgbotapi.WebhookConfig{URL: &appConfig.webhookURL})
-		if err != nil {
-			log.Fatal(err)
+		if appConfig.apiToken != "" {
+			http.HandleFunc(apiSendPath, apiSendHandler(appConfig.apiToken, bot.apiSignal))
 		}
 
-		botUpdatesChan = bot.ListenForWebhook(appConfig.webhookURL.Path)
 		server = &http.Server{Addr: appConfig.bindAddr}
 		go func() {
 			log.Println("Listening incoming requests at ", appConfig.bindAddr)
 			log.Fatal(server.ListenAndServe())
 		}()
-	} else {
-		botUpdatesChan, err = bot.GetUpdatesChan(tgbotConfig)
-		if err != nil {
+	}
+
+	var ctlListener net.Listener
+	if appConfig.ctlSocket != "" {
+		if ctlListener, err = ctlListen(appConfig.ctlSocket, bot.ctlSignal); err != nil {
 			log.Fatal(err)
 		}
+		log.Println("Listening ctl requests at ", appConfig.ctlSocket)
 	}
 
-	users := NewUsers(appConfig)
-	messageSignal := make(chan BotMessage, MessagesQueueSize)
-	vacuumTicker := time.Tick(SecondsForOldUsersBeforeVacuum * time.Second)
-	saveToBDTicker := make(<-chan time.Time)
-	oneThreadMutex := sync.Mutex{}
-	exitSignal := make(chan struct{})
 	systemExitSignal := make(chan os.Signal, 1)
 	signal.Notify(systemExitSignal, os.Interrupt)
+	systemReloadSignal := make(chan os.Signal, 1)
+	signal.Notify(systemReloadSignal, syscall.SIGHUP)
 
-	if appConfig.persistentUsers {
-		saveToBDTicker = time.Tick(SecondsForAutoSaveUsersToDB * time.Second)
-	}
+	bot.Run(systemExitSignal, systemReloadSignal)
 
-	var cache raphanus.DB
-	if appConfig.cache > 0 {
-		cache = raphanus.New()
+	if server != nil {
+		log.Println(server.Close())
 	}
-
-	// all /shell2telegram sub-commands handlers
-	internalCommands := map[string]func(Ctx) string{
-		"stat":              cmdShell2telegramStat,
-		"ban":               cmdShell2telegramBan,
-		"search":            cmdShell2telegramSearch,
-		"desc":              cmdShell2telegramDesc,
-		"rm":                cmdShell2telegramRm,
-		"exit":              cmdShell2telegramExit,
-		"version":           cmdShell2telegramVersion,
-		"broadcast_to_root": cmdShell2telegramBroadcastToRoot,
-		"message_to_user":   cmdShell2telegramMessageToUser,
-	}
-
-	doExit := false
-	for !doExit {
-		select {
-		case telegramUpdate := <-botUpdatesChan:
-
-			var messageCmd, messageArgs string
-			allUserMessage := telegramUpdate.Message.Text
-			if len(allUserMessage) > 0 && allUserMessage[0] == '/' {
-				messageCmd, messageArgs = splitStringHalfBySpace(allUserMessage)
-			} else {
-				messageCmd, messageArgs = cmdPlainText, allUserMessage
-			}
-
-			allowPlainText := false
-			if _, ok := commands[cmdPlainText]; ok {
-				allowPlainText = true
-			}
-
-			replayMsg := ""
-
-			if len(messageCmd) > 0 && (messageCmd != cmdPlainText || allowPlainText) {
-
-				users.AddNew(telegramUpdate.Message)
-				userID := telegramUpdate.Message.From.ID
-				allowExec := appConfig.allowAll || users.IsAuthorized(userID)
-
-				ctx := Ctx{
-					appConfig:      &appConfig,
-					users:          &users,
-					commands:       commands,
-					userID:         userID,
-					allowExec:      allowExec,
-					messageCmd:     messageCmd,
-					messageArgs:    messageArgs,
-					messageSignal:  messageSignal,
-					chatID:         telegramUpdate.Message.Chat.ID,
-					exitSignal:     exitSignal,
-					cache:          &cache,
-					oneThreadMutex: &oneThreadMutex,
-				}
-
-				switch {
-				// commands .................................
-				case !appConfig.isPublicBot && (messageCmd == "/auth" || messageCmd == "/authroot"):
-					replayMsg = cmdAuth(ctx)
-
-				case messageCmd == "/help":
-					replayMsg = cmdHelp(ctx)
-
-				case messageCmd == "/shell2telegram" && users.IsRoot(userID):
-					var messageSubCmd string
-					messageSubCmd, messageArgs = splitStringHalfBySpace(messageArgs)
-					ctx.messageArgs = messageArgs
-					if cmdHandler, ok := internalCommands[messageSubCmd]; ok {
-						replayMsg = cmdHandler(ctx)
-					} else {
-						replayMsg = "Sub-command not found"
-					}
-
-				case allowExec && (allowPlainText && messageCmd == cmdPlainText || messageCmd[0] == '/'):
-					cmdUser(ctx)
-
-				} // switch for commands
-
-				if appConfig.logCommands {
-					log.Printf("%s: %s", users.String(userID), allUserMessage)
-				}
-
-				sendMessage(messageSignal, telegramUpdate.Message.Chat.ID, []byte(replayMsg), false)
-			}
-
-		case botMessage := <-messageSignal:
-			switch {
-			case botMessage.messageType == msgIsText && !stringIsEmpty(botMessage.message):
-				messageConfig := tgbotapi.NewMessage(botMessage.chatID, botMessage.message)
-				if botMessage.isMarkdown {
-					messageConfig.ParseMode = tgbotapi.ModeMarkdown
-				}
-				_, err = bot.Send(messageConfig)
-			case botMessage.messageType == msgIsPhoto && len(botMessage.photo) > 0:
-				bytesPhoto := tgbotapi.FileBytes{Name: botMessage.fileName, Bytes: botMessage.photo}
-				_, err = bot.Send(tgbotapi.NewPhotoUpload(botMessage.chatID, bytesPhoto))
-			}
-
-			if err != nil {
-				log.Printf("failed to send message: %s", err)
-			}
-
-		case <-saveToBDTicker:
-			users.SaveToDB(appConfig.usersDB)
-
-		case <-vacuumTicker:
-			users.ClearOldUsers()
-
-		case <-systemExitSignal:
-			go func() {
-				exitSignal <- struct{}{}
-			}()
-
-		case <-exitSignal:
-			if appConfig.persistentUsers {
-				users.needSaveDB = true
-				users.SaveToDB(appConfig.usersDB)
-			}
-			if server != nil {
-				log.Println(server.Close())
-			}
-			doExit = true
-		}
+	if ctlListener != nil {
+		log.Println(ctlListener.Close())
 	}
 }
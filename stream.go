@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamBuffer - output of running command, safe for write from command and read from stream loop
+type streamBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+// Write - implement io.Writer
+func (buffer *streamBuffer) Write(data []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.data = append(buffer.data, data...)
+	return len(data), nil
+}
+
+// tail - last lines of text output, "" if output is not a text
+func (buffer *streamBuffer) tail(maxSize int) string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if messageType, _ := detectOutputFile(buffer.data); messageType != msgIsText {
+		return ""
+	}
+	return getOutputTail(string(buffer.data), maxSize)
+}
+
+// streamCommand - run command, send message and edit it with last lines of output while command runs,
+// at the end edit message with whole output and exit status
+func streamCommand(ctx Ctx, cmd Command, run func(stream io.Writer) ([]byte, execStatus)) {
+	sentID := make(chan int, 1)
+	ctx.messageSignal <- BotMessage{
+		chatID:      ctx.chatID,
+		messageType: msgIsText,
+		message:     "Running " + ctx.messageCmd + "...",
+		sentID:      sentID,
+	}
+	messageID := <-sentID
+
+	editMessage := func(text string) {
+		if messageID != 0 {
+			ctx.messageSignal <- BotMessage{
+				chatID:      ctx.chatID,
+				messageType: msgIsEdit,
+				messageID:   messageID,
+				message:     text,
+			}
+		}
+	}
+
+	buffer := &streamBuffer{}
+	done := make(chan struct{})
+	var output []byte
+	var status execStatus
+	go func() {
+		output, status = run(buffer)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(StreamEditInterval * time.Second)
+	defer ticker.Stop()
+
+	lastText := ""
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			if text := buffer.tail(MaxMessageLength); !stringIsEmpty(text) && text != lastText {
+				editMessage(text)
+				lastText = text
+			}
+		case <-done:
+			running = false
+		}
+	}
+
+	statusText := "Finished: " + status.String()
+	if status.err != nil {
+		statusText = "Failed: " + status.String()
+	}
+
+	outputText := strings.TrimRight(string(output), "\n")
+	if messageID != 0 && cmd.getFormat() == "" && !isDocumentOutput(cmd, output, ctx.appConfig.documentSize) &&
+		len(outputText)+len(statusText)+2 <= MaxMessageLength {
+		if messageType, _ := detectOutputFile(output); messageType == msgIsText {
+			if outputText != "" {
+				outputText += "\n\n"
+			}
+			editMessage(outputText + statusText)
+			return
+		}
+	}
+
+	// output with formatting, file or too long output
+	editMessage(statusText)
+	sendCommandOutput(ctx, cmd, output)
+}
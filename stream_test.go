@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/msoap/raphanus"
+)
+
+func Test_streamCommand(t *testing.T) {
+	data := []struct {
+		shellCmd string
+		result   string // regexp
+	}{
+		{"echo ok", `^ok\n\nFinished: exit code 0, \d+s$`},
+		{"echo one; echo two; exit 3", `^one\ntwo\n\nFailed: exit code 3, \d+s$`},
+		{"exit 1", `^Failed: exit code 1, \d+s$`},
+	}
+
+	for _, item := range data {
+		messageSignal := make(chan BotMessage, MessagesQueueSize)
+		cache := raphanus.New()
+		_, command, _ := parseBotCommand("/build:stream", item.shellCmd)
+
+		ctx := Ctx{
+			appConfig:      &Config{shell: "sh"},
+			users:          &Users{list: map[int]*User{1: {UserID: 1, UserName: "user1", IsAuthorized: true}}},
+			commands:       Commands{"/build": command},
+			userID:         1,
+			chatID:         100,
+			allowExec:      true,
+			messageCmd:     "/build",
+			messageSignal:  messageSignal,
+			cache:          &cache,
+			oneThreadMutex: &sync.Mutex{},
+			jobs:           NewJobs(),
+		}
+
+		cmdUser(ctx)
+		startMessage := <-messageSignal
+		if startMessage.message != "Running /build..." || startMessage.sentID == nil {
+			t.Fatalf("Failing for %q: start message %#v", item.shellCmd, startMessage)
+		}
+		startMessage.sentID <- 42
+
+		if edit := <-messageSignal; edit.messageType != msgIsEdit || edit.messageID != 42 || !regexp.MustCompile(item.result).MatchString(edit.message) {
+			t.Errorf("Failing for %q\nexpected: %q, real: %#v", item.shellCmd, item.result, edit)
+		}
+	}
+}
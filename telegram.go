@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// Telegram API types and methods which are not supported by telegram-bot-api.v2
+
+// Update - telegram update with callback query
+type Update struct {
+	tgbotapi.Update
+	CallbackQuery *CallbackQuery `json:"callback_query"`
+}
+
+// CallbackQuery - user pressed inline keyboard button
+type CallbackQuery struct {
+	ID      string            `json:"id"`
+	From    tgbotapi.User     `json:"from"`
+	Message *tgbotapi.Message `json:"message"`
+	Data    string            `json:"data"`
+}
+
+// InlineKeyboardMarkup - inline keyboard under message
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// InlineKeyboardButton - one button of inline keyboard
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+	URL          string `json:"url,omitempty"`
+}
+
+// InlineQueryResultArticle - result of inline query, sent as text message when user chooses it
+type InlineQueryResultArticle struct {
+	Type                string                  `json:"type"`
+	ID                  string                  `json:"id"`
+	Title               string                  `json:"title"`
+	Description         string                  `json:"description,omitempty"`
+	URL                 string                  `json:"url,omitempty"`
+	InputMessageContent InputTextMessageContent `json:"input_message_content"`
+}
+
+// InputTextMessageContent - content of message for inline query result
+type InputTextMessageContent struct {
+	MessageText string `json:"message_text"`
+	ParseMode   string `json:"parse_mode,omitempty"`
+}
+
+// BotCommand - command in bot menu
+type BotCommand struct {
+	Command     string `json:"command"` // name of command without "/"
+	Description string `json:"description"`
+}
+
+// BotCommandScope - chats for which bot menu is set: default, all_private_chats, chat (with chat ID)
+type BotCommandScope struct {
+	Type   string `json:"type"`
+	ChatID int    `json:"chat_id,omitempty"`
+}
+
+// messageFile - file from user message
+type messageFile struct {
+	fileID   string // telegram file ID for download
+	fileName string // original file name, may be empty
+	mimeType string // MIME type of file
+	size     int    // size of file in bytes, may be 0 if unknown
+}
+
+// env - get environment variables for shell command with file
+func (file messageFile) env(filePath string) []string {
+	return []string{
+		"S2T_FILE_PATH=" + filePath,
+		"S2T_FILE_NAME=" + file.fileName,
+		"S2T_FILE_MIME=" + file.mimeType,
+	}
+}
+
+// downloadFile - download file from telegram to temporary file, whole download is limited by timeout (in seconds)
+func downloadFile(bot *tgbotapi.BotAPI, file messageFile, maxSize, timeout int) (filePath string, err error) {
+	if maxSize > 0 && file.size > maxSize {
+		return "", fmt.Errorf("file is too large (max %d bytes)", maxSize)
+	}
+
+	fileURL, err := bot.GetFileDirectURL(file.fileID)
+	if err != nil {
+		return "", err
+	}
+
+	client := http.Client{Timeout: time.Duration(timeout) * time.Second}
+	resp, err := client.Get(fileURL) // #nosec
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// don't log URL with bot token
+			err = urlErr.Err
+		}
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download file failed: %s", resp.Status)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "shell2telegram-*"+path.Ext(fileURL))
+	if err != nil {
+		return "", err
+	}
+
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		// file size may be unknown before download
+		body = io.LimitReader(resp.Body, int64(maxSize)+1)
+	}
+
+	size, err := io.Copy(tmpFile, body)
+	if errClose := tmpFile.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil && maxSize > 0 && size > int64(maxSize) {
+		err = fmt.Errorf("file is too large (max %d bytes)", maxSize)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// getUpdatesChan - get updates via long polling
+func getUpdatesChan(bot *tgbotapi.BotAPI, timeout int) <-chan Update {
+	updatesChan := make(chan Update, 100)
+
+	go func() {
+		offset := 0
+		for {
+			params := url.Values{}
+			params.Set("offset", strconv.Itoa(offset))
+			params.Set("timeout", strconv.Itoa(timeout))
+
+			updates := []Update{}
+			resp, err := bot.MakeRequest("getUpdates", params)
+			if err == nil {
+				err = json.Unmarshal(resp.Result, &updates)
+			}
+			if err != nil {
+				log.Printf("failed to get updates: %s, retrying in 3 seconds...", err)
+				time.Sleep(time.Second * 3)
+				continue
+			}
+
+			for _, update := range updates {
+				if update.UpdateID >= offset {
+					offset = update.UpdateID + 1
+					updatesChan <- update
+				}
+			}
+		}
+	}()
+
+	return updatesChan
+}
+
+// listenForWebhook - get updates via webhook
+func listenForWebhook(pattern string) <-chan Update {
+	updatesChan := make(chan Update, 100)
+
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("failed to read webhook request: %s", err)
+			return
+		}
+
+		update := Update{}
+		if err = json.Unmarshal(body, &update); err != nil {
+			log.Printf("failed to parse webhook request: %s", err)
+			return
+		}
+
+		updatesChan <- update
+	})
+
+	return updatesChan
+}
+
+// editMessageText - replace text and inline keyboard of message
+func editMessageText(bot *tgbotapi.BotAPI, chatID, messageID int, text string, replyMarkup interface{}) error {
+	params := url.Values{}
+	params.Set("chat_id", strconv.Itoa(chatID))
+	params.Set("message_id", strconv.Itoa(messageID))
+	params.Set("text", text)
+	if replyMarkup != nil {
+		markupJSON, err := json.Marshal(replyMarkup)
+		if err != nil {
+			return err
+		}
+		params.Set("reply_markup", string(markupJSON))
+	}
+
+	_, err := bot.MakeRequest("editMessageText", params)
+	return err
+}
+
+// answerCallbackQuery - stop loading animation on button, show notification if text is not empty
+func answerCallbackQuery(bot *tgbotapi.BotAPI, callbackQueryID, text string) error {
+	params := url.Values{}
+	params.Set("callback_query_id", callbackQueryID)
+	if text != "" {
+		params.Set("text", text)
+	}
+
+	_, err := bot.MakeRequest("answerCallbackQuery", params)
+	return err
+}
+
+// answerInlineQuery - send results of inline query, results are personal because they depend on authorization of user
+func answerInlineQuery(bot *tgbotapi.BotAPI, inlineQueryID string, results []InlineQueryResultArticle, cacheTime int) error {
+	if results == nil {
+		results = []InlineQueryResultArticle{}
+	}
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("inline_query_id", inlineQueryID)
+	params.Set("results", string(resultsJSON))
+	params.Set("cache_time", strconv.Itoa(cacheTime))
+	params.Set("is_personal", "true")
+
+	_, err = bot.MakeRequest("answerInlineQuery", params)
+	return err
+}
+
+// setMyCommands - set bot menu for scope
+func setMyCommands(bot *tgbotapi.BotAPI, scope BotCommandScope, commands []BotCommand) error {
+	commandsJSON, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	scopeJSON, err := json.Marshal(scope)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("commands", string(commandsJSON))
+	params.Set("scope", string(scopeJSON))
+
+	_, err = bot.MakeRequest("setMyCommands", params)
+	return err
+}
+
+// deleteMyCommands - delete bot menu for scope
+func deleteMyCommands(bot *tgbotapi.BotAPI, scope BotCommandScope) error {
+	scopeJSON, err := json.Marshal(scope)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("scope", string(scopeJSON))
+
+	_, err = bot.MakeRequest("deleteMyCommands", params)
+	return err
+}
+
+// uploadMethods - API method and field name for upload file by message type
+var uploadMethods = map[int8]struct{ method, field string }{
+	msgIsDocument:  {"sendDocument", "document"},
+	msgIsVideo:     {"sendVideo", "video"},
+	msgIsAnimation: {"sendAnimation", "animation"},
+	msgIsAudio:     {"sendAudio", "audio"},
+}
+
+// isFileMessage - message must be sent by uploadFile
+func isFileMessage(messageType int8) bool {
+	_, ok := uploadMethods[messageType]
+	return ok
+}
+
+// uploadFile - send document, video, animation or audio with caption
+func uploadFile(bot *tgbotapi.BotAPI, botMessage BotMessage) error {
+	upload, ok := uploadMethods[botMessage.messageType]
+	if !ok {
+		return fmt.Errorf("unknown type of file message: %d", botMessage.messageType)
+	}
+
+	params := map[string]string{"chat_id": strconv.Itoa(botMessage.chatID)}
+	if botMessage.caption != "" {
+		params["caption"] = botMessage.caption
+	}
+	if botMessage.replyToID != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(botMessage.replyToID)
+	}
+	if botMessage.silent {
+		params["disable_notification"] = "true"
+	}
+	if botMessage.replyMarkup != nil {
+		markupJSON, err := json.Marshal(botMessage.replyMarkup)
+		if err != nil {
+			return err
+		}
+		params["reply_markup"] = string(markupJSON)
+	}
+
+	fileBytes := tgbotapi.FileBytes{Name: botMessage.fileName, Bytes: botMessage.fileData}
+	_, err := bot.UploadFile(upload.method, params, upload.field, fileBytes)
+	if urlErr, ok := err.(*url.Error); ok {
+		// don't log URL with bot token
+		err = urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// Transport - connection of bot with Telegram: receive updates, send messages and files,
+// edit messages, answer callbacks and inline queries, download files from users, set bot menu
+type Transport interface {
+	Updates() <-chan Update
+	SendText(message BotMessage) (messageID int, err error)
+	SendFile(message BotMessage) error // photo, document, video, animation, audio with caption
+	EditText(chatID, messageID int, text string, replyMarkup interface{}) error
+	AnswerCallback(callbackQueryID, text string) error
+	AnswerInline(inlineQueryID string, results []InlineQueryResultArticle, cacheTime int) error
+	DownloadFile(file messageFile, maxSize int) (filePath string, err error)
+	SetMenu(scope BotCommandScope, commands []BotCommand) error
+	DeleteMenu(scope BotCommandScope) error
+}
+
+// telegramTransport - Transport via Telegram Bot API
+type telegramTransport struct {
+	bot             *tgbotapi.BotAPI
+	updates         <-chan Update
+	downloadTimeout int // timeout for download file from user (in seconds)
+}
+
+// newTelegramTransport - connect to Telegram Bot API, get updates via webhook (if -webhook is set) or via long polling
+func newTelegramTransport(appConfig *Config) (*telegramTransport, error) {
+	bot, err := tgbotapi.NewBotAPI(appConfig.token)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Authorized on bot account: @%s", bot.Self.UserName)
+
+	transport := &telegramTransport{bot: bot, downloadTimeout: appConfig.botTimeout}
+	if appConfig.bindAddr != "" && appConfig.webhookURL.String() != "" {
+		if _, err = bot.SetWebhook(tgbotapi.WebhookConfig{URL: &appConfig.webhookURL}); err != nil {
+			return nil, err
+		}
+		transport.updates = listenForWebhook(appConfig.webhookURL.Path)
+	} else {
+		transport.updates = getUpdatesChan(bot, appConfig.botTimeout)
+	}
+
+	return transport, nil
+}
+
+// Updates - channel with updates from Telegram
+func (transport *telegramTransport) Updates() <-chan Update {
+	return transport.updates
+}
+
+// SendText - send text message, returns ID of sent message
+func (transport *telegramTransport) SendText(message BotMessage) (int, error) {
+	messageConfig := tgbotapi.NewMessage(message.chatID, message.message)
+	messageConfig.ParseMode = message.parseMode
+	messageConfig.ReplyMarkup = message.replyMarkup
+	messageConfig.ReplyToMessageID = message.replyToID
+	messageConfig.DisableNotification = message.silent
+
+	sentMessage, err := transport.bot.Send(messageConfig)
+	return sentMessage.MessageID, err
+}
+
+// SendFile - send photo or upload document, video, animation, audio
+func (transport *telegramTransport) SendFile(message BotMessage) error {
+	if message.messageType != msgIsPhoto {
+		return uploadFile(transport.bot, message)
+	}
+
+	bytesPhoto := tgbotapi.FileBytes{Name: message.fileName, Bytes: message.fileData}
+	photoConfig := tgbotapi.NewPhotoUpload(message.chatID, bytesPhoto)
+	photoConfig.Caption = message.caption
+	photoConfig.ReplyMarkup = message.replyMarkup
+	photoConfig.ReplyToMessageID = message.replyToID
+	photoConfig.DisableNotification = message.silent
+	_, err := transport.bot.Send(photoConfig)
+	return err
+}
+
+// EditText - replace text and inline keyboard of message
+func (transport *telegramTransport) EditText(chatID, messageID int, text string, replyMarkup interface{}) error {
+	return editMessageText(transport.bot, chatID, messageID, text, replyMarkup)
+}
+
+// AnswerCallback - answer to pressed inline button
+func (transport *telegramTransport) AnswerCallback(callbackQueryID, text string) error {
+	return answerCallbackQuery(transport.bot, callbackQueryID, text)
+}
+
+// AnswerInline - answer to inline query with results
+func (transport *telegramTransport) AnswerInline(inlineQueryID string, results []InlineQueryResultArticle, cacheTime int) error {
+	return answerInlineQuery(transport.bot, inlineQueryID, results, cacheTime)
+}
+
+// DownloadFile - download file from user to temporary file
+func (transport *telegramTransport) DownloadFile(file messageFile, maxSize int) (string, error) {
+	return downloadFile(transport.bot, file, maxSize, transport.downloadTimeout)
+}
+
+// SetMenu - set bot menu for scope
+func (transport *telegramTransport) SetMenu(scope BotCommandScope, commands []BotCommand) error {
+	return setMyCommands(transport.bot, scope, commands)
+}
+
+// DeleteMenu - delete bot menu for scope
+func (transport *telegramTransport) DeleteMenu(scope BotCommandScope) error {
+	return deleteMyCommands(transport.bot, scope)
+}
+
+// sendToTransport - send message of any type via transport, returns ID of sent text message
+func sendToTransport(transport Transport, message BotMessage) (messageID int, err error) {
+	switch {
+	case message.messageType == msgIsText:
+		if stringIsEmpty(message.message) {
+			return 0, nil
+		}
+		return transport.SendText(message)
+	case message.messageType == msgIsPhoto || isFileMessage(message.messageType):
+		if len(message.fileData) == 0 {
+			return 0, nil
+		}
+		return 0, transport.SendFile(message)
+	case message.messageType == msgIsEdit:
+		return 0, transport.EditText(message.chatID, message.messageID, message.message, message.replyMarkup)
+	case message.messageType == msgIsCallbackAnswer:
+		return 0, transport.AnswerCallback(message.callbackQueryID, message.message)
+	case message.messageType == msgIsInlineAnswer:
+		return 0, transport.AnswerInline(message.inlineQueryID, message.inlineResults, message.cacheTime)
+	}
+
+	return 0, fmt.Errorf("unknown type of message: %d", message.messageType)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v2"
+)
+
+// fakeTransport - in-memory Transport for tests: updates are pushed by test, all sent messages,
+// edits and answers are recorded as BotMessage in sent channel
+type fakeTransport struct {
+	updates chan Update
+	sent    chan BotMessage
+	mutex   sync.Mutex
+	lastID  int
+	menu    botMenu
+	files   map[string]string // content of files from users by file ID
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		updates: make(chan Update),
+		sent:    make(chan BotMessage, 100),
+		menu:    botMenu{},
+		files:   map[string]string{},
+	}
+}
+
+func (transport *fakeTransport) Updates() <-chan Update {
+	return transport.updates
+}
+
+func (transport *fakeTransport) SendText(message BotMessage) (int, error) {
+	transport.mutex.Lock()
+	transport.lastID++
+	messageID := transport.lastID
+	transport.mutex.Unlock()
+
+	message.sentID = nil
+	message.messageID = messageID
+	transport.sent <- message
+	return messageID, nil
+}
+
+func (transport *fakeTransport) SendFile(message BotMessage) error {
+	transport.sent <- message
+	return nil
+}
+
+func (transport *fakeTransport) EditText(chatID, messageID int, text string, replyMarkup interface{}) error {
+	transport.sent <- BotMessage{messageType: msgIsEdit, chatID: chatID, messageID: messageID, message: text, replyMarkup: replyMarkup}
+	return nil
+}
+
+func (transport *fakeTransport) AnswerCallback(callbackQueryID, text string) error {
+	transport.sent <- BotMessage{messageType: msgIsCallbackAnswer, callbackQueryID: callbackQueryID, message: text}
+	return nil
+}
+
+func (transport *fakeTransport) AnswerInline(inlineQueryID string, results []InlineQueryResultArticle, cacheTime int) error {
+	transport.sent <- BotMessage{messageType: msgIsInlineAnswer, inlineQueryID: inlineQueryID, inlineResults: results, cacheTime: cacheTime}
+	return nil
+}
+
+func (transport *fakeTransport) DownloadFile(file messageFile, maxSize int) (string, error) {
+	transport.mutex.Lock()
+	content, ok := transport.files[file.fileID]
+	transport.mutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("file %s not found", file.fileID)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "shell2telegram-test-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = tmpFile.WriteString(content); err != nil {
+		_ = tmpFile.Close()
+		return "", err
+	}
+	return tmpFile.Name(), tmpFile.Close()
+}
+
+func (transport *fakeTransport) SetMenu(scope BotCommandScope, commands []BotCommand) error {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.menu[scope] = commands
+	return nil
+}
+
+func (transport *fakeTransport) DeleteMenu(scope BotCommandScope) error {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	delete(transport.menu, scope)
+	return nil
+}
+
+// sendText - send text message from user to bot in private chat, chat ID is equal to user ID
+func (transport *fakeTransport) sendText(userID int, userName, text string) {
+	transport.updates <- Update{Update: tgbotapi.Update{Message: tgbotapi.Message{
+		MessageID: 1,
+		From:      tgbotapi.User{ID: userID, UserName: userName, FirstName: userName},
+		Chat:      tgbotapi.Chat{ID: userID, Type: "private"},
+		Text:      text,
+	}}}
+}
+
+// waitMessages - wait for count of messages from bot, order of messages sent from different goroutines is not defined
+func (transport *fakeTransport) waitMessages(t *testing.T, count int) []BotMessage {
+	t.Helper()
+	messages := []BotMessage{}
+	timeout := time.After(5 * time.Second)
+	for len(messages) < count {
+		select {
+		case message := <-transport.sent:
+			messages = append(messages, message)
+		case <-timeout:
+			t.Fatalf("wait for %d messages from bot, got: %#v", count, messages)
+		}
+	}
+	return messages
+}
+
+// waitMessage - wait for one message from bot
+func (transport *fakeTransport) waitMessage(t *testing.T) BotMessage {
+	t.Helper()
+	return transport.waitMessages(t, 1)[0]
+}
+
+// waitMenu - wait while bot menu for scope is published
+func (transport *fakeTransport) waitMenu(t *testing.T, scope BotCommandScope, check func([]BotCommand) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		transport.mutex.Lock()
+		commands, ok := transport.menu[scope]
+		transport.mutex.Unlock()
+		if ok && check(commands) {
+			return
+		}
+	}
+	t.Fatalf("bot menu for %#v is not published", scope)
+}
+
+func Test_sendToTransport(t *testing.T) {
+	data := []struct {
+		message BotMessage
+		sent    bool
+		errText string
+	}{
+		{BotMessage{chatID: 1, messageType: msgIsText, message: "hello"}, true, ""},
+		{BotMessage{chatID: 1, messageType: msgIsText, message: " \n"}, false, ""},
+		{BotMessage{chatID: 1, messageType: msgIsPhoto, fileData: []byte("image")}, true, ""},
+		{BotMessage{chatID: 1, messageType: msgIsDocument}, false, ""},
+		{BotMessage{chatID: 1, messageType: msgIsAudio, fileData: []byte("audio")}, true, ""},
+		{BotMessage{chatID: 1, messageType: msgIsEdit, messageID: 2, message: "edited"}, true, ""},
+		{BotMessage{messageType: msgIsCallbackAnswer, callbackQueryID: "q1", message: "ok"}, true, ""},
+		{BotMessage{messageType: msgIsInlineAnswer, inlineQueryID: "q2"}, true, ""},
+		{BotMessage{messageType: 100}, false, "unknown type of message: 100"},
+	}
+
+	for i, item := range data {
+		transport := newFakeTransport()
+		_, err := sendToTransport(transport, item.message)
+		if err != nil && err.Error() != item.errText || err == nil && item.errText != "" {
+			t.Errorf("%d. sendToTransport() failed, error: %v, expected: %q", i+1, err, item.errText)
+		}
+
+		select {
+		case message := <-transport.sent:
+			message.messageID = item.message.messageID
+			if !item.sent || !reflect.DeepEqual(message, item.message) {
+				t.Errorf("%d. sendToTransport() failed, sent: %#v, expected: %#v", i+1, message, item.message)
+			}
+		default:
+			if item.sent {
+				t.Errorf("%d. sendToTransport() failed, message is not sent: %#v", i+1, item.message)
+			}
+		}
+	}
+}
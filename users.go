@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +23,7 @@ type User struct {
 	AuthCodeRoot   string    `json:"auth_code_root"`   // code for authorize root
 	IsAuthorized   bool      `json:"is_authorized"`    // user allow chat with bot
 	IsRoot         bool      `json:"is_root"`          // user is root, allow authorize/ban other users, remove commands, stop bot
+	Roles          []string  `json:"roles,omitempty"`  // roles of user, for run commands allowed for these roles
 	PrivateChatID  int       `json:"private_chat_id"`  // last private chat with bot
 	Counter        int       `json:"counter"`          // how many commands send
 	LastAccessTime time.Time `json:"last_access_time"` // time of last command
@@ -32,13 +34,15 @@ type Users struct {
 	list                   map[int]*User
 	predefinedAllowedUsers map[string]bool
 	predefinedRootUsers    map[string]bool
-	needSaveDB             bool // non-saved changes in list
+	schedules              map[string]*Schedule // scheduled commands by name
+	needSaveDB             bool                 // non-saved changes in list
 }
 
 // UsersDB -  save list of Users into JSON
 type UsersDB struct {
-	Users    []User    `json:"users"`
-	DateTime time.Time `json:"date_time"`
+	Users     []User     `json:"users"`
+	Schedules []Schedule `json:"schedules,omitempty"`
+	DateTime  time.Time  `json:"date_time"`
 }
 
 // SecondsForOldUsersBeforeVacuum - clear old users after 20 minutes after login
@@ -47,16 +51,25 @@ const SecondsForOldUsersBeforeVacuum = 1200
 // NewUsers - create Users object
 func NewUsers(appConfig Config) Users {
 	users := Users{
-		predefinedAllowedUsers: map[string]bool{},
-		predefinedRootUsers:    map[string]bool{},
-		list:                   map[int]*User{},
-		needSaveDB:             true,
+		list:       map[int]*User{},
+		schedules:  map[string]*Schedule{},
+		needSaveDB: true,
 	}
 
 	if appConfig.persistentUsers {
 		users.LoadFromDB(appConfig.usersDB)
 	}
 
+	users.SetPredefinedUsers(appConfig)
+	users.SetConfigSchedules(appConfig.schedules)
+	return users
+}
+
+// SetPredefinedUsers - set users and roots from config, who will be authorized on first message
+func (users *Users) SetPredefinedUsers(appConfig Config) {
+	users.predefinedAllowedUsers = map[string]bool{}
+	users.predefinedRootUsers = map[string]bool{}
+
 	for _, name := range appConfig.predefinedAllowedUsers {
 		users.predefinedAllowedUsers[name] = true
 	}
@@ -64,7 +77,37 @@ func NewUsers(appConfig Config) Users {
 		users.predefinedAllowedUsers[name] = true
 		users.predefinedRootUsers[name] = true
 	}
-	return users
+}
+
+// UpdatePredefinedUsers - set users and roots from reloaded config, known users who were added to
+// or removed from -allow-users/-root-users get or lose access right away
+func (users *Users) UpdatePredefinedUsers(appConfig Config) {
+	oldAllowedUsers, oldRootUsers := users.predefinedAllowedUsers, users.predefinedRootUsers
+	users.SetPredefinedUsers(appConfig)
+
+	for _, user := range users.list {
+		name := user.UserName
+		if name == "" {
+			continue
+		}
+
+		isAuthorized, isRoot := user.IsAuthorized, user.IsRoot
+		if users.predefinedAllowedUsers[name] && !oldAllowedUsers[name] {
+			user.IsAuthorized = true
+		} else if !users.predefinedAllowedUsers[name] && oldAllowedUsers[name] {
+			user.IsAuthorized = false
+		}
+		if users.predefinedRootUsers[name] && !oldRootUsers[name] {
+			user.IsRoot = true
+		} else if !users.predefinedRootUsers[name] && oldRootUsers[name] || !user.IsAuthorized {
+			user.IsRoot = false
+		}
+
+		if user.IsAuthorized != isAuthorized || user.IsRoot != isRoot {
+			log.Printf("access of %s changed by config: authorized: %v, root: %v", users.String(user.UserID), user.IsAuthorized, user.IsRoot)
+			users.needSaveDB = true
+		}
+	}
 }
 
 // AddNew - add new user if not exists
@@ -155,13 +198,93 @@ func (users Users) IsRoot(userID int) bool {
 	return isRoot
 }
 
+// RootChatID - private chat of root user, 0 if user is not root or private chat is unknown
+func (users Users) RootChatID(userID int) int {
+	if user, ok := users.list[userID]; ok && user.IsRoot {
+		return user.PrivateChatID
+	}
+	return 0
+}
+
+// HasRole - check user has one of roles
+func (users Users) HasRole(userID int, roles []string) bool {
+	if user, ok := users.list[userID]; ok {
+		for _, role := range user.Roles {
+			if stringInList(role, roles) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// AddRole - add role to user, returns false if user not found
+func (users *Users) AddRole(userID int, role string) bool {
+	user, ok := users.list[userID]
+	if !ok {
+		return false
+	}
+
+	if !stringInList(role, user.Roles) {
+		user.Roles = append(user.Roles, role)
+		sort.Strings(user.Roles)
+		users.needSaveDB = true
+	}
+	return true
+}
+
+// RemoveRole - remove role from user, returns false if user don't have this role
+func (users *Users) RemoveRole(userID int, role string) bool {
+	user, ok := users.list[userID]
+	if !ok || !stringInList(role, user.Roles) {
+		return false
+	}
+
+	roles := []string{}
+	for _, userRole := range user.Roles {
+		if userRole != role {
+			roles = append(roles, userRole)
+		}
+	}
+	user.Roles = roles
+	users.needSaveDB = true
+
+	return true
+}
+
+// InList - check user is in list of @logins or IDs
+func (users Users) InList(userID int, list []string) bool {
+	user, ok := users.list[userID]
+	if !ok {
+		return false
+	}
+
+	for _, userName := range list {
+		if userName == strconv.Itoa(userID) || user.UserName != "" && cleanUserName(userName) == user.UserName {
+			return true
+		}
+	}
+
+	return false
+}
+
 // BroadcastForRoots - send message to all root users
 func (users Users) BroadcastForRoots(messageSignal chan<- BotMessage, message string, excludeID int) {
+	for _, chatID := range users.RootChatIDs(excludeID) {
+		sendMessage(messageSignal, chatID, []byte(message), "")
+	}
+}
+
+// RootChatIDs - get private chats of root users
+func (users Users) RootChatIDs(excludeID int) []int {
+	result := []int{}
 	for userID, user := range users.list {
 		if user.IsRoot && user.PrivateChatID > 0 && (excludeID == 0 || excludeID != userID) {
-			sendMessage(messageSignal, user.PrivateChatID, []byte(message), false)
+			result = append(result, user.PrivateChatID)
 		}
 	}
+	return result
 }
 
 // String - format user name
@@ -173,14 +296,24 @@ func (users Users) String(userID int) string {
 	return result
 }
 
+// ShellUser - user for S2T_* variables of shell command, names are empty for unknown user (in schedules)
+func (users Users) ShellUser(userID, chatID int) ShellUser {
+	shellUser := ShellUser{userID: userID, chatID: chatID}
+	if user, ok := users.list[userID]; ok {
+		shellUser.login, shellUser.displayName = user.UserName, user.FirstName+" "+user.LastName
+	}
+	return shellUser
+}
+
 // StringVerbose - format user name with all fields
 func (users Users) StringVerbose(userID int) string {
 	user := users.list[userID]
-	result := fmt.Sprintf("%s: id: %d, auth: %v, root: %v, count: %d, last: %v",
+	result := fmt.Sprintf("%s: id: %d, auth: %v, root: %v, roles: %s, count: %d, last: %v",
 		users.String(userID),
 		userID,
 		user.IsAuthorized,
 		user.IsRoot,
+		strings.Join(user.Roles, ","),
 		user.Counter,
 		user.LastAccessTime.Format("2006-01-02 15:04:05"),
 	)
@@ -218,6 +351,7 @@ func (users *Users) BanUser(userID int) bool {
 	if _, ok := users.list[userID]; ok {
 		users.list[userID].IsAuthorized = false
 		users.list[userID].IsRoot = false
+		users.list[userID].Roles = nil
 		if users.list[userID].UserName != "" {
 			delete(users.predefinedAllowedUsers, users.list[userID].UserName)
 			delete(users.predefinedRootUsers, users.list[userID].UserName)
@@ -265,7 +399,7 @@ func (users Users) FindByIDOrUserName(userName string) int {
 // SendMessageToPrivate - send message to user to private chat
 func (users Users) SendMessageToPrivate(messageSignal chan<- BotMessage, userID int, message string) bool {
 	if user, ok := users.list[userID]; ok && user.PrivateChatID > 0 {
-		sendMessage(messageSignal, user.PrivateChatID, []byte(message), false)
+		sendMessage(messageSignal, user.PrivateChatID, []byte(message), "")
 		return true
 	}
 	return false
@@ -283,6 +417,26 @@ func (users *Users) LoadFromDB(usersDBFile string) {
 				user := user
 				users.list[user.UserID] = &user
 			}
+			for _, row := range usersList.Schedules {
+				row := row
+				if row.FromConfig {
+					// only paused state is used, schedule is replaced by schedule from config file
+					users.schedules[row.Name] = &row
+					continue
+				}
+				if row.BotCmd == "" {
+					// shell commands are allowed only in config file
+					log.Printf("Load schedule from usersDB error: schedule %s without bot command is skipped", row.Name)
+					continue
+				}
+				schedule, err := newCommandSchedule(row.Name, row.Cron, row.Targets, row.BotCmd, row.UserID)
+				if err != nil {
+					log.Printf("Load schedule from usersDB error: %s", err)
+					continue
+				}
+				schedule.Paused = row.Paused
+				users.schedules[schedule.Name] = &schedule
+			}
 		}
 	}
 	if err == nil {
@@ -304,6 +458,7 @@ func (users *Users) SaveToDB(usersDBFile string) {
 		for _, user := range users.list {
 			usersList.Users = append(usersList.Users, *user)
 		}
+		usersList.Schedules = users.Schedules()
 
 		fileNamePath := getDBFilePath(usersDBFile, true)
 		jsonBytes, err := json.MarshalIndent(usersList, "", "  ")
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	shellwords "github.com/mattn/go-shellwords"
 	"github.com/msoap/raphanus"
@@ -24,36 +29,83 @@ import (
 // codeBytesLength - length of random code in bytes
 const codeBytesLength = 15
 
-// exec shell commands with text to STDIN
-func execShell(shellCmd, input string, varsNames []string, userID, chatID int, userName, userDisplayName string, cache *raphanus.DB, cacheTTL int, config *Config) (result []byte) {
-	cacheKey := shellCmd + "/" + input
+// execStatus - how shell command finished
+type execStatus struct {
+	err      error         // error of start or exit of command, nil on success
+	exitCode int           // exit code of command, -1 if command was killed or not started
+	duration time.Duration // duration of command
+	timeout  bool          // command was killed by timeout
+	killed   bool          // command was killed by /kill
+	cached   bool          // output from cache
+}
+
+// ShellUser - user who runs shell command, for S2T_* variables of command
+type ShellUser struct {
+	userID      int    // S2T_USERID
+	chatID      int    // S2T_CHATID
+	login       string // S2T_LOGIN, telegram @login
+	displayName string // S2T_USERNAME, first and last name
+}
+
+// String - format status for footer of command output
+func (status execStatus) String() string {
+	duration := status.duration.Round(100 * time.Millisecond)
+	switch {
+	case status.cached:
+		return "exit code 0 (from cache)"
+	case status.timeout:
+		return fmt.Sprintf("timeout, killed after %s", duration)
+	case status.killed:
+		return fmt.Sprintf("killed after %s", duration)
+	case status.err != nil && status.exitCode == -1:
+		return fmt.Sprintf("exec error: %s", status.err)
+	default:
+		return fmt.Sprintf("exit code %d, %s", status.exitCode, duration)
+	}
+}
+
+// exec shell commands with text to STDIN, output is also written to stream if it is not nil,
+// command is killed when ctx is canceled, onStart is called with PID of started process
+func execShell(ctx context.Context, cmd Command, input string, extraEnv []string, stream io.Writer, onStart func(pid int), user ShellUser, cache *raphanus.DB, cacheTTL int, config *Config) (result []byte, status execStatus) {
+	if err := ctx.Err(); err != nil {
+		// job was killed before start, while it waited for other command in -one-thread mode
+		return nil, execStatus{err: err, exitCode: -1, killed: true}
+	}
+
+	shellCmd, varsNames := cmd.shellCmd, cmd.vars
+	customShell := config.shell
+	if cmd.shell != "" {
+		customShell = cmd.shell
+	}
+
+	cacheKey := getCacheKey(cmd, customShell, input)
 	if cacheTTL > 0 {
 		if cacheData, err := cache.GetBytes(cacheKey); err != raphanuscommon.ErrKeyNotExists && err != nil {
 			log.Printf("get from cache failed: %s", err)
 		} else if err == nil {
 			// cache hit
-			return cacheData
+			return cacheData, execStatus{cached: true}
 		}
 	}
 
-	shell, params, err := getShellAndParams(shellCmd, config.shell, runtime.GOOS == "windows")
+	shell, params, err := getShellAndParams(shellCmd, customShell, runtime.GOOS == "windows")
 	if err != nil {
 		log.Print("parse shell failed: ", err)
-		return nil
+		return nil, execStatus{err: err, exitCode: -1}
 	}
 
-	ctx := context.Background()
-	if config.shTimeout > 0 {
+	jobCtx := ctx
+	if timeout := commandOption(cmd.timeout, config.shTimeout); timeout > 0 {
 		var cancelFn context.CancelFunc
-		ctx, cancelFn = context.WithTimeout(ctx, time.Duration(config.shTimeout)*time.Second)
+		ctx, cancelFn = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 		defer cancelFn()
 	}
 
-	osExecCommand := exec.CommandContext(ctx, shell, params...) // #nosec
+	osExecCommand := exec.Command(shell, params...) // #nosec
+	setProcessGroup(osExecCommand)
 	osExecCommand.Stderr = os.Stderr
-
-	// copy variables from parent process
-	osExecCommand.Env = append(osExecCommand.Env, os.Environ()...)
+	osExecCommand.Dir = cmd.cwd
+	osExecCommand.Env = getShellEnv(os.Environ(), cmd.env, config.cleanEnv, config.envAllow)
 
 	if input != "" {
 		if len(varsNames) > 0 {
@@ -81,21 +133,56 @@ func execShell(shellCmd, input string, varsNames []string, userID, chatID int, u
 
 	// set S2T_* env vars
 	s2tVariables := [...]struct{ name, value string }{
-		{"S2T_LOGIN", userName},
-		{"S2T_USERID", strconv.Itoa(userID)},
-		{"S2T_USERNAME", userDisplayName},
-		{"S2T_CHATID", strconv.Itoa(chatID)},
+		{"S2T_LOGIN", user.login},
+		{"S2T_USERID", strconv.Itoa(user.userID)},
+		{"S2T_USERNAME", user.displayName},
+		{"S2T_CHATID", strconv.Itoa(user.chatID)},
 	}
 	for _, row := range s2tVariables {
 		osExecCommand.Env = append(osExecCommand.Env, fmt.Sprintf("%s=%s", row.name, row.value))
 	}
+	osExecCommand.Env = append(osExecCommand.Env, extraEnv...)
+
+	shellOut := bytes.Buffer{}
+	osExecCommand.Stdout = &shellOut
+	if stream != nil {
+		osExecCommand.Stdout = io.MultiWriter(&shellOut, stream)
+	}
+	if cmd.withStderr {
+		osExecCommand.Stderr = osExecCommand.Stdout
+	}
 
-	shellOut, err := osExecCommand.Output()
+	startTime := time.Now()
+	if err = osExecCommand.Start(); err == nil {
+		if onStart != nil {
+			onStart(osExecCommand.Process.Pid)
+		}
+
+		finished := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				// by timeout or /kill
+				if errKill := killProcessGroup(osExecCommand.Process); errKill != nil {
+					log.Printf("kill process failed: %s", errKill)
+				}
+			case <-finished:
+			}
+		}()
+		err = osExecCommand.Wait()
+		close(finished)
+	}
+	result, status = shellOut.Bytes(), execStatus{err: err, duration: time.Since(startTime)}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status.exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		status.exitCode = -1
+	}
 	if err != nil {
+		status.timeout = ctx.Err() == context.DeadlineExceeded && jobCtx.Err() == nil
+		status.killed = jobCtx.Err() != nil
 		log.Print("exec error: ", err)
-		result = []byte(fmt.Sprintf("exec error: %s", err))
-	} else {
-		result = shellOut
+		return result, status
 	}
 
 	if cacheTTL > 0 {
@@ -104,6 +191,52 @@ func execShell(shellCmd, input string, varsNames []string, userID, chatID int, u
 		}
 	}
 
+	return result, status
+}
+
+// getCacheKey - key for cache of command output, commands with the same shell command but
+// with different shell, working directory or environment don't share output
+func getCacheKey(cmd Command, shell, input string) string {
+	env := make([]string, 0, len(cmd.env))
+	for name, value := range cmd.env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return strings.Join([]string{
+		shell,
+		cmd.cwd,
+		strings.Join(env, "\x00"),
+		strings.Join(cmd.vars, ","),
+		cmd.shellCmd,
+		input,
+	}, "\x00")
+}
+
+// getShellEnv - get environment variables for shell command:
+// variables from parent process (only allowed in clean environment mode) and command variables
+func getShellEnv(parentEnv []string, commandEnv map[string]string, cleanEnv bool, envAllow []string) (result []string) {
+	allowed := map[string]bool{}
+	for _, name := range envAllow {
+		allowed[name] = true
+	}
+
+	for _, row := range parentEnv {
+		name, _ := splitStringHalfBy(row, "=")
+		if !cleanEnv || allowed[name] {
+			result = append(result, row)
+		}
+	}
+
+	names := []string{}
+	for name := range commandEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, name+"="+commandEnv[name])
+	}
+
 	return result
 }
 
@@ -129,6 +262,17 @@ func splitStringHalfBySpace(str string) (one, two string) {
 	return one, two
 }
 
+// splitStringHalfBy - split string to 2 parts by separator, second="" if string don't contain separator
+func splitStringHalfBy(str, separator string) (one, two string) {
+	array := strings.SplitN(str, separator, 2)
+	one, two = array[0], ""
+	if len(array) > 1 {
+		two = array[1]
+	}
+
+	return one, two
+}
+
 // cleanUserName - remove @ from telegram username
 func cleanUserName(in string) string {
 	return regexp.MustCompile("@").ReplaceAllLiteralString(in, "")
@@ -154,58 +298,27 @@ func parseBotCommand(pathRaw, shellCmd string) (path string, command Command, er
 		return "", command, fmt.Errorf("error: shell command cannot be empty")
 	}
 
-	parseAttrFn := func(varsParts []string) (command Command, err error) {
-		for _, oneVar := range varsParts {
-			oneVarParts := regexp.MustCompile("=").Split(oneVar, 2)
-			if len(oneVarParts) == 1 && oneVarParts[0] == "md" {
-				command.isMarkdown = true
-			} else if len(oneVarParts) != 2 {
-				err = fmt.Errorf("error: parse command modificators: %s", oneVar)
-				return
-			} else if oneVarParts[0] == "desc" {
-				command.description = oneVarParts[1]
-				if command.description == "" {
-					err = fmt.Errorf("error: command description cannot be empty")
-					return
-				}
-			} else if oneVarParts[0] == "vars" {
-				command.vars = regexp.MustCompile(",").Split(oneVarParts[1], -1)
-				for _, oneVarName := range command.vars {
-					if oneVarName == "" {
-						err = fmt.Errorf("error: var name cannot be empty")
-						return
-					}
-				}
-			} else {
-				err = fmt.Errorf("error: parse command modificators, not found %s", oneVarParts[0])
-				return
-			}
-		}
-
-		return command, nil
-	}
-
 	pathParts := regexp.MustCompile(":").Split(pathRaw, -1)
 	switch {
 	case len(pathParts) == 1:
 		// /, /cmd
 		path = pathParts[0]
-	case pathParts[0] == "/" && regexp.MustCompile("^(plain_text|image)$").MatchString(pathParts[1]):
-		// /:plain_text, /:image, /:plain_text:desc=name
+	case pathParts[0] == "/" && regexp.MustCompile("^(plain_text|image|document|voice|location|contact|inline)$").MatchString(pathParts[1]):
+		// /:plain_text, /:image, /:document, /:voice, /:location, /:contact, /:inline, /:plain_text:desc=name
 		path = "/:" + pathParts[1]
-		if pathParts[1] == "image" {
-			return "", command, fmt.Errorf("/:image not implemented")
-		}
-		if len(pathParts) > 2 {
-			command, err = parseAttrFn(pathParts[2:])
+		for _, attr := range pathParts[2:] {
+			if err = parseCommandAttr(&command, attr); err != nil {
+				return "", command, err
+			}
 		}
 	case len(pathParts) > 1:
 		// commands with modificators :desc, :vars
 		path = pathParts[0]
-		command, err = parseAttrFn(pathParts[1:])
-	}
-	if err != nil {
-		return "", command, err
+		for _, attr := range pathParts[1:] {
+			if err = parseCommandAttr(&command, attr); err != nil {
+				return "", command, err
+			}
+		}
 	}
 
 	command.shellCmd = shellCmd
@@ -213,6 +326,228 @@ func parseBotCommand(pathRaw, shellCmd string) (path string, command Command, er
 	return path, command, nil
 }
 
+// parseCommandAttr - parse one command modificator (md, root, confirm, accept_file, as_document, stream, stderr, status, desc=..., format=..., output=json, vars=..., users=..., roles=..., re=..., ...)
+func parseCommandAttr(command *Command, attr string) error {
+	attrParts := regexp.MustCompile("=").Split(attr, 2)
+	if len(attrParts) == 1 {
+		switch attrParts[0] {
+		case "md":
+			command.isMarkdown = true
+		case "root":
+			command.rootOnly = true
+		case "confirm":
+			command.confirm = true
+		case "accept_file":
+			command.acceptFile = true
+		case "as_document":
+			command.asDocument = true
+		case "stream":
+			command.stream = true
+		case "stderr":
+			command.withStderr = true
+		case "status":
+			command.showStatus = true
+		default:
+			return fmt.Errorf("error: parse command modificators: %s", attr)
+		}
+		return nil
+	}
+
+	name, value := attrParts[0], attrParts[1]
+	switch name {
+	case "desc":
+		if value == "" {
+			return fmt.Errorf("error: command description cannot be empty")
+		}
+		command.description = value
+	case "vars":
+		command.vars = regexp.MustCompile(",").Split(value, -1)
+		for _, oneVarName := range command.vars {
+			if oneVarName == "" {
+				return fmt.Errorf("error: var name cannot be empty")
+			}
+		}
+	case "timeout", "cache":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("error: %s must be a number of seconds: %s", name, value)
+		}
+		if seconds == 0 {
+			// disable default value from -sh-timeout/-cache
+			seconds = -1
+		}
+		if name == "timeout" {
+			command.timeout = seconds
+		} else {
+			command.cache = seconds
+		}
+	case "shell":
+		if value == "" {
+			return fmt.Errorf("error: command shell cannot be empty")
+		}
+		command.shell = value
+	case "cwd":
+		if value == "" {
+			return fmt.Errorf("error: command working directory cannot be empty")
+		}
+		command.cwd = value
+	case "env":
+		envName, envValue := splitStringHalfBy(value, "=")
+		if !strings.Contains(value, "=") || !regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`).MatchString(envName) {
+			return fmt.Errorf("error: env must be in NAME=value form: %s", value)
+		}
+		if command.env == nil {
+			command.env = map[string]string{}
+		}
+		command.env[envName] = envValue
+	case "users":
+		command.allowUsers = nil
+		for _, userName := range regexp.MustCompile(",").Split(value, -1) {
+			if userName = cleanUserName(userName); userName == "" {
+				return fmt.Errorf("error: user name cannot be empty")
+			}
+			command.allowUsers = append(command.allowUsers, userName)
+		}
+	case "roles":
+		command.allowRoles = regexp.MustCompile(",").Split(value, -1)
+		for _, role := range command.allowRoles {
+			if role == "" {
+				return fmt.Errorf("error: role name cannot be empty")
+			}
+		}
+	case "re", "int", "enum", "maxlen":
+		if err := parseArgCheck(command, name, value); err != nil {
+			return err
+		}
+	case "format":
+		if !isValidFormat(value) {
+			return fmt.Errorf("error: format must be one of markdown, markdownv2, html, pre: %s", value)
+		}
+		command.format = value
+	case "output":
+		if value != "json" {
+			return fmt.Errorf("error: output must be json: %s", value)
+		}
+		command.outputJSON = true
+	case "on_error":
+		if value != onErrorOnly && value != onErrorRoots {
+			return fmt.Errorf("error: on_error must be %s or %s: %s", onErrorOnly, onErrorRoots, value)
+		}
+		command.onError = value
+	case "as_document":
+		if value == "" || strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("error: document name must be a file name without path: %s", value)
+		}
+		command.asDocument = true
+		command.docName = value
+	case "chats":
+		command.allowChats = nil
+		for _, chatIDRaw := range regexp.MustCompile(",").Split(value, -1) {
+			chatID, err := strconv.Atoi(chatIDRaw)
+			if err != nil {
+				return fmt.Errorf("error: chat ID must be a number: %s", chatIDRaw)
+			}
+			command.allowChats = append(command.allowChats, chatID)
+		}
+	default:
+		return fmt.Errorf("error: parse command modificators, not found %s", name)
+	}
+
+	return nil
+}
+
+// checkCommands - check that all roles of commands are defined in config and validated arguments are defined
+func checkCommands(commands Commands, roles []string) error {
+	for path, command := range commands {
+		for _, role := range command.allowRoles {
+			if !stringInList(role, roles) {
+				return fmt.Errorf("error: role %s of command %s is not defined in -roles", role, path)
+			}
+		}
+		if err := checkArgNames(command); err != nil {
+			return fmt.Errorf("%s (command %s)", err, path)
+		}
+		if command.outputJSON && (command.stream || command.asDocument) {
+			return fmt.Errorf("error: :output=json cannot be used with :stream or :as_document (command %s)", path)
+		}
+		if command.stream && command.onError != "" {
+			return fmt.Errorf("error: :stream cannot be used with :on_error, output is sent while command runs (command %s)", path)
+		}
+	}
+
+	return nil
+}
+
+// copy - get copy of commands map
+func (commands Commands) copy() Commands {
+	result := make(Commands, len(commands))
+	for path, command := range commands {
+		result[path] = command
+	}
+	return result
+}
+
+// stringInList - check string is in list
+func stringInList(str string, list []string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commandOption - get value of command option (timeout, cache) or default value from config
+func commandOption(value, defaultValue int) int {
+	switch {
+	case value == 0:
+		return defaultValue
+	case value < 0:
+		return 0
+	default:
+		return value
+	}
+}
+
+// commandsDiff - describe added, removed and changed commands
+func commandsDiff(oldCommands, newCommands Commands) string {
+	added, removed, changed := []string{}, []string{}, []string{}
+	for path, command := range newCommands {
+		if oldCommand, ok := oldCommands[path]; !ok {
+			added = append(added, path)
+		} else if !reflect.DeepEqual(oldCommand, command) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range oldCommands {
+		if _, ok := newCommands[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+
+	if len(added)+len(removed)+len(changed) == 0 {
+		return "commands not changed"
+	}
+
+	result := []string{"commands:"}
+	for _, row := range []struct {
+		title string
+		list  []string
+	}{
+		{"added", added},
+		{"removed", removed},
+		{"changed", changed},
+	} {
+		if len(row.list) > 0 {
+			sort.Strings(row.list)
+			result = append(result, row.title+": "+strings.Join(row.list, ", "))
+		}
+	}
+
+	return strings.Join(result, "\n")
+}
+
 // stringIsEmpty - check string is empty
 func stringIsEmpty(str string) bool {
 	isEmpty, _ := regexp.MatchString(`^\s*$`, str)
@@ -244,6 +579,78 @@ func splitStringLinesBySize(input string, maxSize int) []string {
 	return result
 }
 
+// detectOutputFile - detect type of command output by content: text, image, video, audio, ...
+func detectOutputFile(output []byte) (messageType int8, fileName string) {
+	switch http.DetectContentType(output) {
+	case "image/png":
+		return msgIsPhoto, "file.png"
+	case "image/jpeg":
+		return msgIsPhoto, "file.jpeg"
+	case "image/bmp":
+		return msgIsPhoto, "file.bmp"
+	case "image/gif":
+		return msgIsAnimation, "file.gif"
+	case "video/mp4":
+		return msgIsVideo, "file.mp4"
+	case "audio/mpeg":
+		return msgIsAudio, "file.mp3"
+	case "application/ogg":
+		return msgIsAudio, "file.ogg"
+	case "application/pdf":
+		return msgIsDocument, "file.pdf"
+	case "application/zip":
+		return msgIsDocument, "file.zip"
+	default:
+		return msgIsText, ""
+	}
+}
+
+// getOutputTail - get last lines of output, not longer than maxSize bytes
+func getOutputTail(output string, maxSize int) string {
+	if len(output) <= maxSize {
+		return output
+	}
+
+	output = output[len(output)-maxSize:]
+	if i := strings.IndexByte(output, '\n'); i >= 0 && i < len(output)-1 {
+		return output[i+1:]
+	}
+
+	// one long line, cut it on the boundary of UTF-8 character
+	for len(output) > 0 && !utf8.RuneStart(output[0]) {
+		output = output[1:]
+	}
+	return output
+}
+
+// isDocumentOutput - check that text output of command must be sent as document
+func isDocumentOutput(cmd Command, output []byte, documentSize int) bool {
+	if stringIsEmpty(string(output)) || !strings.HasPrefix(http.DetectContentType(output), "text/") {
+		return false
+	}
+
+	return cmd.asDocument || documentSize > 0 && len(output) > documentSize
+}
+
+// getOutputPreview - get first lines of output for caption of document
+func getOutputPreview(output string, lines int) string {
+	if lines <= 0 {
+		return ""
+	}
+
+	parts := strings.SplitN(output, "\n", lines+1)
+	if len(parts) > lines {
+		parts = parts[:lines]
+	}
+
+	preview := []rune(strings.TrimRight(strings.Join(parts, "\n"), "\n"))
+	if len(preview) > MaxCaptionLength {
+		preview = append(preview[:MaxCaptionLength-1], '…')
+	}
+
+	return string(preview)
+}
+
 // create dir if it is not exists
 func createDirIfNeed(dir string) {
 	if _, err := os.Stat(dir); err != nil {
@@ -325,3 +732,23 @@ func (v urlValue) Set(s string) error {
 	*v.URL = *u
 	return nil
 }
+
+// ------------------------------
+type stringListValue struct {
+	list *[]string
+}
+
+func (v stringListValue) String() string {
+	if v.list != nil {
+		return strings.Join(*v.list, ",")
+	}
+	return ""
+}
+
+func (v stringListValue) Set(s string) error {
+	*v.list = nil
+	if s != "" {
+		*v.list = strings.Split(s, ",")
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/msoap/raphanus"
 )
 
 func Test_splitStringHalfBySpace(t *testing.T) {
@@ -166,14 +170,36 @@ func Test_parseBotCommand(t *testing.T) {
 			pathRaw:  "/:image",
 			shellCmd: "ls",
 			// out
-			path: "",
+			path: "/:image",
 			command: Command{
-				shellCmd:    "",
+				shellCmd:    "ls",
 				description: "",
 				vars:        nil,
 				isMarkdown:  false,
 			},
-			errFunc: fmt.Errorf("/:image not implemented"),
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/:document:desc=Upload",
+			shellCmd: "ls",
+			// out
+			path: "/:document",
+			command: Command{
+				shellCmd:    "ls",
+				description: "Upload",
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/upload:accept_file",
+			shellCmd: "ls",
+			// out
+			path: "/upload",
+			command: Command{
+				shellCmd:   "ls",
+				acceptFile: true,
+			},
+			errFunc: nil,
 		},
 		{
 			pathRaw:  "/:plain_text:desc=Name",
@@ -188,6 +214,126 @@ func Test_parseBotCommand(t *testing.T) {
 			},
 			errFunc: nil,
 		},
+		{
+			pathRaw:  "/cmd:timeout=30:cache=300:shell=bash",
+			shellCmd: "ls",
+			// out
+			path: "/cmd",
+			command: Command{
+				shellCmd: "ls",
+				timeout:  30,
+				cache:    300,
+				shell:    "bash",
+			},
+			errFunc: nil,
+		},
+		{
+			// disable default timeout and cache
+			pathRaw:  "/cmd:timeout=0:cache=0",
+			shellCmd: "ls",
+			// out
+			path: "/cmd",
+			command: Command{
+				shellCmd: "ls",
+				timeout:  -1,
+				cache:    -1,
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/cmd:cwd=/srv/app:env=FOO=bar:env=EMPTY=:env=OPTS=a=b",
+			shellCmd: "ls",
+			// out
+			path: "/cmd",
+			command: Command{
+				shellCmd: "ls",
+				cwd:      "/srv/app",
+				env:      map[string]string{"FOO": "bar", "EMPTY": "", "OPTS": "a=b"},
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/cmd:root:users=@user1,12345:chats=-100123,456",
+			shellCmd: "ls",
+			// out
+			path: "/cmd",
+			command: Command{
+				shellCmd:   "ls",
+				rootOnly:   true,
+				allowUsers: []string{"user1", "12345"},
+				allowChats: []int{-100123, 456},
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/cmd:roles=ops,deploy",
+			shellCmd: "ls",
+			// out
+			path: "/cmd",
+			command: Command{
+				shellCmd:   "ls",
+				allowRoles: []string{"ops", "deploy"},
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/df:format=pre",
+			shellCmd: "df -h",
+			// out
+			path: "/df",
+			command: Command{
+				shellCmd: "df -h",
+				format:   "pre",
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/backup:stderr:status:on_error=roots",
+			shellCmd: "make backup",
+			// out
+			path: "/backup",
+			command: Command{
+				shellCmd:   "make backup",
+				withStderr: true,
+				showStatus: true,
+				onError:    "roots",
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/report:output=json",
+			shellCmd: "./report.sh",
+			// out
+			path: "/report",
+			command: Command{
+				shellCmd:   "./report.sh",
+				outputJSON: true,
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/logs:as_document",
+			shellCmd: "ls",
+			// out
+			path: "/logs",
+			command: Command{
+				shellCmd:   "ls",
+				asDocument: true,
+			},
+			errFunc: nil,
+		},
+		{
+			pathRaw:  "/logs:as_document=app.log",
+			shellCmd: "ls",
+			// out
+			path: "/logs",
+			command: Command{
+				shellCmd:   "ls",
+				asDocument: true,
+				docName:    "app.log",
+			},
+			errFunc: nil,
+		},
 	}
 
 	for _, item := range data {
@@ -211,6 +357,28 @@ func Test_parseBotCommand(t *testing.T) {
 		"/cmd:desc",
 		"/cmd:desc=",
 		"/cmd:vars=,,,,",
+		"/cmd:timeout=",
+		"/cmd:timeout=-1",
+		"/cmd:cache=abc",
+		"/cmd:shell=",
+		"/cmd:cwd=",
+		"/cmd:env=",
+		"/cmd:env=FOO",
+		"/cmd:env=1FOO=bar",
+		"/cmd:root=1",
+		"/cmd:users=",
+		"/cmd:users=user1,,user2",
+		"/cmd:chats=abc",
+		"/cmd:roles=",
+		"/cmd:roles=ops,",
+		"/cmd:format=",
+		"/cmd:format=xml",
+		"/cmd:on_error",
+		"/cmd:on_error=always",
+		"/cmd:output",
+		"/cmd:output=xml",
+		"/cmd:as_document=",
+		"/cmd:as_document=../app.log",
 	}
 	for _, path := range invalidPaths {
 		_, _, errFunc := parseBotCommand(path, "ls")
@@ -293,6 +461,91 @@ func Test_splitStringLinesBySize(t *testing.T) {
 	}
 }
 
+func Test_detectOutputFile(t *testing.T) {
+	data := []struct {
+		output      string
+		messageType int8
+		fileName    string
+	}{
+		{"plain text", msgIsText, ""},
+		{"\x89PNG\x0D\x0A\x1A\x0A", msgIsPhoto, "file.png"},
+		{"GIF89a", msgIsAnimation, "file.gif"},
+		{"\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom", msgIsVideo, "file.mp4"},
+		{"ID3\x03\x00", msgIsAudio, "file.mp3"},
+		{"OggS\x00", msgIsAudio, "file.ogg"},
+		{"%PDF-1.4", msgIsDocument, "file.pdf"},
+		{"PK\x03\x04", msgIsDocument, "file.zip"},
+	}
+
+	for _, item := range data {
+		messageType, fileName := detectOutputFile([]byte(item.output))
+		if messageType != item.messageType || fileName != item.fileName {
+			t.Errorf("Failing for %q\nexpected: %d, %s, real: %d, %s", item.output, item.messageType, item.fileName, messageType, fileName)
+		}
+	}
+}
+
+func Test_getOutputTail(t *testing.T) {
+	data := []struct {
+		output  string
+		maxSize int
+		tail    string
+	}{
+		{"1\n2\n3", 10, "1\n2\n3"},
+		{"11\n22\n33", 6, "22\n33"},
+		{"11\n22\n33", 5, "33"},
+		{"11\n22\n33\n", 7, "22\n33\n"},
+		{"ыыы", 3, "ы"},
+	}
+
+	for _, item := range data {
+		if tail := getOutputTail(item.output, item.maxSize); tail != item.tail {
+			t.Errorf("Failing for %q (by %d)\nexpected: %q, real: %q", item.output, item.maxSize, item.tail, tail)
+		}
+	}
+}
+
+func Test_isDocumentOutput(t *testing.T) {
+	data := []struct {
+		cmd          Command
+		output       string
+		documentSize int
+		isDocument   bool
+	}{
+		{Command{}, "short text", 0, false},
+		{Command{}, "short text", 5, true},
+		{Command{}, "short text", 100, false},
+		{Command{asDocument: true}, "short text", 0, true},
+		{Command{asDocument: true}, " \n", 0, false},
+		{Command{asDocument: true}, "\x89PNG\x0D\x0A\x1A\x0A", 0, false},
+	}
+
+	for _, item := range data {
+		if isDocument := isDocumentOutput(item.cmd, []byte(item.output), item.documentSize); isDocument != item.isDocument {
+			t.Errorf("Failing for %q (size: %d)\nexpected: %v, real: %v", item.output, item.documentSize, item.isDocument, isDocument)
+		}
+	}
+}
+
+func Test_getOutputPreview(t *testing.T) {
+	data := []struct {
+		output  string
+		lines   int
+		preview string
+	}{
+		{"1\n2\n3\n", 0, ""},
+		{"1\n2\n3\n", 2, "1\n2"},
+		{"1\n2\n3\n", 5, "1\n2\n3"},
+		{strings.Repeat("ы", MaxCaptionLength+10), 1, strings.Repeat("ы", MaxCaptionLength-1) + "…"},
+	}
+
+	for _, item := range data {
+		if preview := getOutputPreview(item.output, item.lines); preview != item.preview {
+			t.Errorf("Failing for %q (lines: %d)\nexpected: %q, real: %q", item.output, item.lines, item.preview, preview)
+		}
+	}
+}
+
 func Test_getRandomCode(t *testing.T) {
 	rnd := getRandomCode()
 	if len(rnd) == 0 {
@@ -395,3 +648,121 @@ func Test_flagURL(t *testing.T) {
 		}
 	}
 }
+
+func Test_commandsDiff(t *testing.T) {
+	oldCommands := Commands{
+		"/date":  {shellCmd: "date"},
+		"/ls":    {shellCmd: "ls"},
+		"/alarm": {shellCmd: "sleep $SLEEP", vars: []string{"SLEEP"}},
+	}
+
+	if diff := commandsDiff(oldCommands, oldCommands); diff != "commands not changed" {
+		t.Errorf("1. commandsDiff() failed: %s", diff)
+	}
+
+	newCommands := Commands{
+		"/date":  {shellCmd: "date"},
+		"/alarm": {shellCmd: "sleep $SLEEP", vars: []string{"SLEEP", "MSG"}},
+		"/ps":    {shellCmd: "ps"},
+		"/df":    {shellCmd: "df"},
+	}
+	expected := "commands:\nadded: /df, /ps\nremoved: /ls\nchanged: /alarm"
+	if diff := commandsDiff(oldCommands, newCommands); diff != expected {
+		t.Errorf("2. commandsDiff() failed\nexpected: %s\nreal: %s", expected, diff)
+	}
+}
+
+func Test_commandOption(t *testing.T) {
+	data := []struct {
+		value, defaultValue, out int
+	}{
+		{0, 0, 0},
+		{0, 10, 10},
+		{30, 10, 30},
+		{-1, 10, 0},
+	}
+
+	for _, item := range data {
+		if out := commandOption(item.value, item.defaultValue); out != item.out {
+			t.Errorf("Failing for %#v\nexpected: %d, real: %d\n", item, item.out, out)
+		}
+	}
+}
+
+func Test_execShellCache(t *testing.T) {
+	cache := raphanus.New()
+	appConfig := &Config{shell: "sh"}
+	dir := t.TempDir()
+
+	data := []struct {
+		pathRaw, shellCmd string
+		out               string
+		cached            bool
+	}{
+		{"/a:cwd=/:cache=60", "pwd", "/\n", false},
+		{"/b:cwd=" + dir + ":cache=60", "pwd", dir + "\n", false},
+		{"/a:cwd=/:cache=60", "pwd", "/\n", true},
+		{"/c:env=FOO=1:cache=60", "echo $FOO", "1\n", false},
+		{"/d:env=FOO=2:cache=60", "echo $FOO", "2\n", false},
+		{"/e:shell=bash:env=FOO=2:cache=60", "echo $FOO", "2\n", false},
+		{"/d:env=FOO=2:cache=60", "echo $FOO", "2\n", true},
+	}
+
+	for i, item := range data {
+		_, cmd, err := parseBotCommand(item.pathRaw, item.shellCmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, status := execShell(context.Background(), cmd, "", nil, nil, nil, ShellUser{userID: 1, chatID: 1}, &cache, 60, appConfig)
+		if string(out) != item.out || status.cached != item.cached {
+			t.Errorf("%d. Failing for %s\nexpected: %q (cached: %v), real: %q (cached: %v)", i+1, item.pathRaw, item.out, item.cached, out, status.cached)
+		}
+	}
+}
+
+func Test_getShellEnv(t *testing.T) {
+	parentEnv := []string{"PATH=/bin", "HOME=/home/user", "TB_TOKEN=secret"}
+	commandEnv := map[string]string{"FOO": "bar", "HOME": "/srv/app"}
+
+	env := getShellEnv(parentEnv, nil, false, nil)
+	if !reflect.DeepEqual(env, parentEnv) {
+		t.Errorf("1. getShellEnv() failed: %#v", env)
+	}
+
+	env = getShellEnv(parentEnv, commandEnv, false, nil)
+	expected := []string{"PATH=/bin", "HOME=/home/user", "TB_TOKEN=secret", "FOO=bar", "HOME=/srv/app"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("2. getShellEnv() failed: %#v", env)
+	}
+
+	env = getShellEnv(parentEnv, commandEnv, true, []string{"PATH", "HOME"})
+	expected = []string{"PATH=/bin", "HOME=/home/user", "FOO=bar", "HOME=/srv/app"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("3. getShellEnv() failed: %#v", env)
+	}
+
+	env = getShellEnv(parentEnv, nil, true, nil)
+	if len(env) != 0 {
+		t.Errorf("4. getShellEnv() failed: %#v", env)
+	}
+}
+
+func Test_checkCommands(t *testing.T) {
+	commands := Commands{
+		"/date":   {shellCmd: "date"},
+		"/deploy": {shellCmd: "make deploy", allowRoles: []string{"ops", "deploy"}},
+	}
+
+	if err := checkCommands(commands, []string{"ops", "deploy", "viewer"}); err != nil {
+		t.Errorf("1. checkCommands() failed: %s", err)
+	}
+	if err := checkCommands(commands, []string{"ops"}); err == nil {
+		t.Errorf("2. checkCommands() failed")
+	}
+	if err := checkCommands(Commands{"/report": {shellCmd: "./report.sh", outputJSON: true, stream: true}}, nil); err == nil {
+		t.Errorf("3. checkCommands() failed")
+	}
+	if err := checkCommands(Commands{"/build": {shellCmd: "make", stream: true, onError: onErrorRoots}}, nil); err == nil {
+		t.Errorf("4. checkCommands() failed")
+	}
+}